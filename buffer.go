@@ -0,0 +1,49 @@
+package quiche
+
+import "sync"
+
+// Buffer is a byte buffer managed by BufferPool.
+type Buffer struct {
+	B []byte
+}
+
+// BufferPool manages reusable packet and stream buffers of a fixed size.
+// It is safe for concurrent use.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBufferPool creates a pool of buffers with the given size.
+func NewBufferPool(size int) *BufferPool {
+	p := &BufferPool{
+		size: size,
+	}
+	p.pool.New = func() interface{} {
+		return &Buffer{
+			B: make([]byte, size),
+		}
+	}
+	return p
+}
+
+// Size returns size of buffers in the pool.
+func (p *BufferPool) Size() int {
+	return p.size
+}
+
+// Get returns a buffer from the pool with its full size.
+func (p *BufferPool) Get() *Buffer {
+	b := p.pool.Get().(*Buffer)
+	b.B = b.B[:cap(b.B)]
+	return b
+}
+
+// Put returns the buffer to the pool. The buffer must not be used after that.
+func (p *BufferPool) Put(b *Buffer) {
+	if cap(b.B) < p.size {
+		// Not from this pool.
+		return
+	}
+	p.pool.Put(b)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goburrow/quiche"
+)
+
+// benchHandler responds to "/<size>" with size bytes of generated data.
+type benchHandler struct{}
+
+func (benchHandler) get(target string) *fileResponse {
+	size, err := strconv.ParseInt(strings.TrimPrefix(target, "/"), 10, 64)
+	if err != nil || size < 0 {
+		return errorResponse(http.StatusNotFound)
+	}
+	return &fileResponse{
+		status:      http.StatusOK,
+		contentType: "application/octet-stream",
+		length:      size,
+		body:        ioutil.NopCloser(io.LimitReader(zeroReader{}, size)),
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// benchConn is the result of a benchmark client connection.
+type benchConn struct {
+	handshake time.Duration
+	finished  time.Duration
+	received  int64
+	stats     quiche.Stats
+	err       error
+}
+
+// benchReport is the benchmark summary.
+type benchReport struct {
+	Conns        int     `json:"conns"`
+	Streams      int     `json:"streams"`
+	Size         int64   `json:"size"`
+	Failed       int     `json:"failed"`
+	Bytes        int64   `json:"bytes"`
+	Duration     float64 `json:"duration_seconds"`
+	Goodput      float64 `json:"goodput_bps"`
+	HandshakeP50 float64 `json:"handshake_p50_ms"`
+	HandshakeP90 float64 `json:"handshake_p90_ms"`
+	HandshakeP99 float64 `json:"handshake_p99_ms"`
+	HandshakeMax float64 `json:"handshake_max_ms"`
+	PacketsSent  uint64  `json:"packets_sent"`
+	PacketsRecv  uint64  `json:"packets_recv"`
+	PacketsLost  uint64  `json:"packets_lost"`
+	RTTMin       float64 `json:"rtt_min_ms"`
+	RTTAvg       float64 `json:"rtt_avg_ms"`
+	RTTMax       float64 `json:"rtt_max_ms"`
+}
+
+func newBenchReport(results []benchConn, elapsed time.Duration) *benchReport {
+	r := &benchReport{
+		Duration: elapsed.Seconds(),
+	}
+	var handshakes, rtts []time.Duration
+	for i := range results {
+		c := &results[i]
+		r.Bytes += c.received
+		r.PacketsSent += c.stats.Sent
+		r.PacketsRecv += c.stats.Recv
+		r.PacketsLost += c.stats.Lost
+		if c.err != nil {
+			r.Failed++
+			continue
+		}
+		handshakes = append(handshakes, c.handshake)
+		rtts = append(rtts, c.stats.RTT)
+	}
+	if elapsed > 0 {
+		r.Goodput = float64(r.Bytes) * 8 / elapsed.Seconds()
+	}
+	if len(handshakes) > 0 {
+		sortDurations(handshakes)
+		r.HandshakeP50 = millis(percentile(handshakes, 50))
+		r.HandshakeP90 = millis(percentile(handshakes, 90))
+		r.HandshakeP99 = millis(percentile(handshakes, 99))
+		r.HandshakeMax = millis(handshakes[len(handshakes)-1])
+		sortDurations(rtts)
+		var sum time.Duration
+		for _, d := range rtts {
+			sum += d
+		}
+		r.RTTMin = millis(rtts[0])
+		r.RTTAvg = millis(sum / time.Duration(len(rtts)))
+		r.RTTMax = millis(rtts[len(rtts)-1])
+	}
+	return r
+}
+
+func (r *benchReport) print(w io.Writer) {
+	fmt.Fprintf(w, "connections: %d (%d failed), streams per connection: %d, stream size: %d\n",
+		r.Conns, r.Failed, r.Streams, r.Size)
+	fmt.Fprintf(w, "transferred: %d bytes in %.3fs, goodput: %.2f Mbit/s\n",
+		r.Bytes, r.Duration, r.Goodput/1e6)
+	fmt.Fprintf(w, "handshake: p50=%.3fms p90=%.3fms p99=%.3fms max=%.3fms\n",
+		r.HandshakeP50, r.HandshakeP90, r.HandshakeP99, r.HandshakeMax)
+	fmt.Fprintf(w, "packets: sent=%d recv=%d lost=%d\n",
+		r.PacketsSent, r.PacketsRecv, r.PacketsLost)
+	fmt.Fprintf(w, "rtt: min=%.3fms avg=%.3fms max=%.3fms\n",
+		r.RTTMin, r.RTTAvg, r.RTTMax)
+}
+
+func sortDurations(d []time.Duration) {
+	sort.Slice(d, func(i, j int) bool {
+		return d[i] < d[j]
+	})
+}
+
+// percentile returns the nearest-rank percentile p of sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i]
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// runBench opens conns concurrent connections to addr, each requesting streams
+// responses of size bytes, and waits for all of them to complete.
+func runBench(config *quiche.Config, h3config *quiche.H3Config, addr string, conns, streams int, size int64) *benchReport {
+	results := make([]benchConn, conns)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range results {
+		wg.Add(1)
+		go func(r *benchConn) {
+			defer wg.Done()
+			r.err = benchConnect(config, h3config, addr, streams, size, r)
+		}(&results[i])
+	}
+	wg.Wait()
+	// Exclude the time spent on closing connections.
+	var elapsed time.Duration
+	for i := range results {
+		if results[i].err == nil && results[i].finished > elapsed {
+			elapsed = results[i].finished
+		}
+	}
+	if elapsed == 0 {
+		elapsed = time.Since(start)
+	}
+	r := newBenchReport(results, elapsed)
+	r.Conns = conns
+	r.Streams = streams
+	r.Size = size
+	return r
+}
+
+func benchConnect(config *quiche.Config, h3config *quiche.H3Config, addr string, streams int, size int64, r *benchConn) error {
+	u := &url.URL{
+		Scheme: "https",
+		Host:   addr,
+		Path:   "/" + strconv.FormatInt(size, 10),
+	}
+	requests := make([]*clientRequest, streams)
+	for i := range requests {
+		requests[i] = &clientRequest{url: u}
+	}
+	c, err := dial(config, h3config, addr, u.Hostname(), requests)
+	if err != nil {
+		return err
+	}
+	defer c.free()
+	c.discard = true
+	err = c.connect()
+	c.conn.Stats(&r.stats)
+	r.handshake = c.handshake
+	r.finished = c.finished
+	for _, req := range requests {
+		r.received += req.received
+	}
+	return err
+}
+
+func benchCommand(args []string) error {
+	cmd := flag.NewFlagSet("bench", flag.ExitOnError)
+	verbose := cmd.Bool("v", false, "enable debug logging")
+	http3 := cmd.Bool("http3", false, "use HTTP/3 instead of HTTP/0.9")
+	listenAddr := cmd.String("listen", "", "only run the server on the given IP:port")
+	connectAddr := cmd.String("connect", "", "only run the client against the server at the given IP:port")
+	certFile := cmd.String("cert", "cert.crt", "TLS certificate path")
+	keyFile := cmd.String("key", "cert.key", "TLS certificate key path")
+	noVerify := cmd.Bool("no-verify", false, "don't verify server's certificate when connecting to a remote server")
+	conns := cmd.Int("conns", 1, "number of concurrent connections")
+	streams := cmd.Int("streams", 1, "number of streams per connection")
+	size := cmd.Int64("size", 10000000, "number of bytes to transfer on each stream")
+	jsonOutput := cmd.Bool("json", false, "print results in JSON")
+	logging := cmd.Bool("log", false, "print connection logs to stderr")
+	cmd.Usage = func() {
+		fmt.Fprintln(cmd.Output(), "Usage: quiche bench [options]")
+		fmt.Fprintln(cmd.Output(), "Without -listen or -connect, both server and client run in this process over loopback.")
+		cmd.PrintDefaults()
+	}
+	cmd.Parse(args)
+
+	if *listenAddr != "" && *connectAddr != "" {
+		return errors.New("-listen and -connect are mutually exclusive")
+	}
+	if *conns < 1 || *streams < 1 || *size < 0 {
+		return errors.New("invalid number of connections, streams or size")
+	}
+	if *verbose {
+		quiche.EnableDebugLogging()
+	}
+	if !*logging {
+		log.SetOutput(ioutil.Discard)
+		// Errors returned are still logged by main.
+		defer log.SetOutput(os.Stderr)
+	}
+	var h3config *quiche.H3Config
+	if *http3 {
+		h3config = newH3Config()
+		defer h3config.Free()
+	}
+	var s *server
+	if *connectAddr == "" {
+		config, err := newConfig(quiche.ProtocolVersion, *http3)
+		if err != nil {
+			return err
+		}
+		defer config.Free()
+		err = config.LoadCertChainFromPEMFile(*certFile)
+		if err != nil {
+			return err
+		}
+		err = config.LoadPrivKeyFromPEMFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		connIDs, err := quiche.NewRandomConnectionIDGenerator(quiche.MaxConnIDLen)
+		if err != nil {
+			return err
+		}
+		opts := serverOptions{
+			listenAddr:       *listenAddr,
+			handler:          benchHandler{},
+			connIDs:          connIDs,
+			limits:           serverLimits{retry: retryNever},
+			disableMigration: true,
+			drainTimeout:     10 * time.Second,
+		}
+		if *listenAddr != "" {
+			return listen(config, h3config, &opts)
+		}
+		opts.listenAddr = "127.0.0.1:0"
+		s, err = newServer(config, h3config, &opts)
+		if err != nil {
+			return err
+		}
+		defer s.socket.Close()
+		go s.listen()
+		*connectAddr = s.socket.LocalAddr().String()
+	}
+	config, err := newConfig(quiche.ProtocolVersion, *http3)
+	if err != nil {
+		return err
+	}
+	defer config.Free()
+	if *noVerify || s != nil {
+		config.VerifyPeer(false)
+	}
+	report := runBench(config, h3config, *connectAddr, *conns, *streams, *size)
+	if s != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		s.shutdown(ctx)
+		cancel()
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		report.print(os.Stdout)
+	}
+	if err == nil && report.Failed > 0 {
+		err = fmt.Errorf("%d of %d connections failed", report.Failed, report.Conns)
+	}
+	return err
+}
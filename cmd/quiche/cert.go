@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/goburrow/quiche"
+	"github.com/goburrow/quiche/internal/certutil"
+)
+
+const defaultCertHosts = "localhost,127.0.0.1,::1"
+
+// loadCert configures the certificate. As the config can only load PEM files,
+// they are written to a temporary directory which is removed afterwards.
+func loadCert(config *quiche.Config, cert *certutil.Cert) error {
+	dir, err := ioutil.TempDir("", "quiche")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.crt")
+	keyFile := filepath.Join(dir, "cert.key")
+	err = cert.WriteFiles(certFile, keyFile, false)
+	if err != nil {
+		return err
+	}
+	err = config.LoadCertChainFromPEMFile(certFile)
+	if err != nil {
+		return err
+	}
+	return config.LoadPrivKeyFromPEMFile(keyFile)
+}
+
+// loadCertFiles configures the certificate and key files if given.
+func loadCertFiles(config *quiche.Config, certFile, keyFile string) error {
+	if certFile != "" {
+		err := config.LoadCertChainFromPEMFile(certFile)
+		if err != nil {
+			return fmt.Errorf("load certificate %s: %v", certFile, err)
+		}
+	}
+	if keyFile != "" {
+		err := config.LoadPrivKeyFromPEMFile(keyFile)
+		if err != nil {
+			return fmt.Errorf("load private key %s: %v", keyFile, err)
+		}
+	}
+	return nil
+}
+
+// loadSelfSigned generates and configures a self-signed certificate.
+func loadSelfSigned(config *quiche.Config, hosts string) error {
+	cert, err := certutil.Generate(hosts, 24*time.Hour)
+	if err != nil {
+		return err
+	}
+	err = loadCert(config, cert)
+	if err != nil {
+		return err
+	}
+	log.Printf("self-signed certificate for %s, SHA-256 fingerprint: %s", hosts, cert.FingerprintString())
+	return nil
+}
+
+func gencertCommand(args []string) error {
+	cmd := flag.NewFlagSet("gencert", flag.ExitOnError)
+	hosts := cmd.String("hosts", defaultCertHosts, "comma-separated host names and IP addresses")
+	certFile := cmd.String("cert", "cert.crt", "TLS certificate path")
+	keyFile := cmd.String("key", "cert.key", "TLS certificate key path")
+	validFor := cmd.Duration("valid", 365*24*time.Hour, "duration that the certificate is valid for")
+	force := cmd.Bool("force", false, "overwrite existing certificate and key files")
+	cmd.Parse(args)
+
+	cert, err := certutil.Generate(*hosts, *validFor)
+	if err != nil {
+		return err
+	}
+	err = cert.WriteFiles(*certFile, *keyFile, *force)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%v (use -force to overwrite)", err)
+		}
+		return err
+	}
+	fmt.Printf("SHA-256 fingerprint: %s\n", cert.FingerprintString())
+	return nil
+}
@@ -1,22 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net"
-	"strings"
+	"net/url"
+	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/goburrow/quiche"
 )
 
-func hostname(addr string) string {
-	idx := strings.LastIndex(addr, ":")
-	if idx < 0 {
-		return addr
-	}
-	return addr[:idx]
-}
+// clientPcap captures datagrams of all client connections if it is not nil.
+var clientPcap *quiche.PcapWriter
+
+// clientQlogDir is the directory to write qlog files of client connections
+// to if it is not empty.
+var clientQlogDir string
+
+// clientStats configures sampling of client connection statistics.
+var clientStats statsOptions
 
 func dialUDP(addr string) (net.Conn, error) {
 	localAddr, err := net.ResolveUDPAddr("udp", "0.0.0.0:0")
@@ -30,31 +37,183 @@ func dialUDP(addr string) (net.Conn, error) {
 	return net.DialUDP("udp", localAddr, remoteAddr)
 }
 
-func connect(config *quiche.Config, addr string) error {
-	socket, err := dialUDP(addr)
+// fetch downloads all URLs using one connection for each server.
+func fetch(config *quiche.Config, h3config *quiche.H3Config, urls []*url.URL, outDir string) error {
+	if outDir != "" {
+		err := checkOutputNames(urls)
+		if err != nil {
+			return err
+		}
+	}
+	var addrs []string
+	requests := make(map[string][]*clientRequest)
+	for _, u := range urls {
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		}
+		if _, ok := requests[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+		requests[addr] = append(requests[addr], &clientRequest{url: u})
+	}
+	for _, addr := range addrs {
+		reqs := requests[addr]
+		err := connect(config, h3config, addr, reqs[0].url.Hostname(), reqs, outDir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func connect(config *quiche.Config, h3config *quiche.H3Config, addr, serverName string, requests []*clientRequest, outDir string) error {
+	c, err := dial(config, h3config, addr, serverName, requests)
 	if err != nil {
 		return err
 	}
-	defer socket.Close()
-
-	scid := newConnID()
-	conn := quiche.Connect(hostname(addr), scid, config)
-	defer conn.Free()
+	defer c.free()
+	c.outDir = outDir
+	return c.connect()
+}
 
-	c := client{
-		socket: socket,
-		conn:   conn,
+// connectEcho runs the echo or discard client against the server at addr.
+func connectEcho(config *quiche.Config, addr string, echo *echoClient) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	c, err := dial(config, nil, addr, host, nil)
+	if err != nil {
+		return err
 	}
+	defer c.free()
+	c.app = echo
 	return c.connect()
 }
 
+// dial creates a client connection to addr without starting the handshake.
+func dial(config *quiche.Config, h3config *quiche.H3Config, addr, serverName string, requests []*clientRequest) (*client, error) {
+	socket, err := dialUDP(addr)
+	if err != nil {
+		return nil, err
+	}
+	connIDs, err := quiche.NewRandomConnectionIDGenerator(quiche.MaxConnIDLen)
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+	scid, err := connIDs.NewConnectionID()
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+	var tracer quiche.Tracer
+	var qlog *os.File
+	if clientQlogDir != "" {
+		// The original destination connection ID is chosen by the library,
+		// so the trace is identified by the source connection ID.
+		tracer, qlog, err = createQlog(clientQlogDir, scid, "client")
+		if err != nil {
+			socket.Close()
+			return nil, err
+		}
+	}
+	c := &client{
+		id:       scid,
+		socket:   socket,
+		conn:     quiche.NewTracedConnection(quiche.Connect(serverName, scid, config), scid, tracer),
+		h3config: h3config,
+		pcap:     clientPcap,
+		qlog:     qlog,
+		sampler:  clientStats.newSampler(scid),
+		requests: requests,
+		streams:  make(map[uint64]*clientRequest),
+
+		nextStreamID: httpRequestStreamID,
+	}
+	return c, nil
+}
+
+// free removes output files of unfinished requests and releases the connection
+// and its socket.
+func (c *client) free() {
+	for _, req := range c.requests {
+		if !req.done {
+			req.close()
+			req.remove()
+		}
+	}
+	if c.h3 != nil {
+		c.h3.Free()
+	}
+	c.conn.Free()
+	c.socket.Close()
+	if c.qlog != nil {
+		c.qlog.Close()
+	}
+}
+
+// clientApp is an application protocol other than HTTP run by the client.
+type clientApp interface {
+	// start is called when the connection is established.
+	start(conn *quiche.TracedConnection)
+	// poll is called after packets are received or the client is woken up.
+	poll(conn *quiche.TracedConnection)
+	// closed returns the result when the connection has been closed.
+	closed() error
+}
+
 type client struct {
+	// id is the source connection ID.
+	id     []byte
 	socket net.Conn
-	conn   *quiche.Connection
+	conn   *quiche.TracedConnection
+	// h3config is nil if HTTP/3 is not enabled.
+	h3config *quiche.H3Config
+	h3       *quiche.H3Connection
+
+	// app is not nil when an application protocol other than HTTP is used.
+	// Requests are empty in that case.
+	app clientApp
+	// woken is set by wake to skip waiting for packets.
+	woken int32
+	// pcap captures all datagrams if it is not nil.
+	pcap *quiche.PcapWriter
+	// qlog is the file of the connection trace if it is not nil.
+	qlog *os.File
+	// sampler is not nil if statistics are sampled periodically.
+	sampler *quiche.StatsSampler
+
+	requests []*clientRequest
+	// sent is the number of requests sent. The rest are queued until the
+	// server allows more streams.
+	sent int
+	// nextStreamID is the stream of the next HTTP/0.9 request.
+	nextStreamID uint64
+	streams      map[uint64]*clientRequest
+	outDir       string
+	// discard is whether response bodies and headers are ignored.
+	discard bool
+	// flushed is the number of requests whose responses have been written to stdout.
+	flushed int
+	// completed is the number of finished requests.
+	completed int
+	// err is the first request failure.
+	err error
+
+	start time.Time
+	// handshake is the duration from start until the connection is established.
+	handshake time.Duration
+	// finished is the duration from start until all requests completed.
+	finished time.Duration
 }
 
 func (c *client) connect() error {
-	buf := make([]byte, bufferSize)
+	b := buffers.Get()
+	defer buffers.Put(b)
+	buf := b.B
+	c.start = time.Now()
 	err := c.send(buf)
 	if err != nil {
 		return err
@@ -67,33 +226,137 @@ func (c *client) connect() error {
 			return err
 		}
 		if c.conn.IsClosed() {
-			log.Print("connection closed")
-			return nil
+			c.closeSampler()
+			var stats quiche.ConnectionStats
+			c.conn.ConnectionStats(&stats, false)
+			log.Println("connection closed:", &stats)
+			if c.app != nil {
+				return c.app.closed()
+			}
+			if c.completed < len(c.requests) {
+				return fmt.Errorf("connection closed with %d of %d responses incomplete",
+					len(c.requests)-c.completed, len(c.requests))
+			}
+			return c.err
 		}
 		if c.conn.IsEstablished() {
 			if !reqSent {
-				log.Print("sending HTTP request")
-				_, err = c.conn.StreamSend(httpRequestStreamID, []byte("GET /\r\n"), true)
+				c.handshake = time.Since(c.start)
+				if c.app != nil {
+					c.app.start(c.conn)
+				} else if c.h3config != nil {
+					c.h3 = quiche.H3Connect(c.conn.Connection, c.h3config)
+					if c.h3 == nil {
+						return errors.New("could not create HTTP/3 connection")
+					}
+				}
+				reqSent = true
+			}
+			if c.app == nil && c.sent < len(c.requests) {
+				if c.h3 != nil {
+					err = c.sendH3Requests()
+				} else {
+					err = c.sendRequests()
+				}
 				if err != nil {
 					return err
 				}
-				reqSent = true
 			}
-			c.recvStream(buf)
+			if c.app != nil {
+				c.app.poll(c.conn)
+			} else if c.h3 != nil {
+				c.pollH3()
+			} else {
+				c.recvStream()
+			}
 		}
 		err = c.send(buf[:maxDatagramSize])
 		if err != nil {
 			return err
 		}
+		if c.sampler != nil {
+			c.sampler.Poll(c.conn.Connection, time.Now())
+		}
+	}
+}
+
+// closeSampler takes the last sample and writes all samples if configured.
+func (c *client) closeSampler() {
+	if c.sampler == nil {
+		return
+	}
+	c.sampler.Sample(c.conn.Connection, time.Now())
+	err := clientStats.dump(c.sampler, c.id, "client")
+	if err != nil {
+		log.Printf("failed to write stats: %v", err)
+	}
+}
+
+// sendRequests sends queued requests, each on its own bidirectional stream,
+// until the server's stream limit is reached.
+func (c *client) sendRequests() error {
+	for c.sent < len(c.requests) {
+		req := c.requests[c.sent]
+		streamID := c.nextStreamID
+		line := req.line()
+		n, err := c.conn.StreamSend(streamID, line, true)
+		if errors.Is(err, quiche.ErrStreamLimit) {
+			// Sent when the server allows more streams.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n < len(line) {
+			return fmt.Errorf("stream %d request truncated: %d of %d bytes sent", streamID, n, len(line))
+		}
+		log.Printf("stream %d sent request: %s", streamID, bytes.TrimSpace(line))
+		err = c.startRequest(req, streamID)
+		if err != nil {
+			return err
+		}
+		c.nextStreamID += 4
 	}
+	return nil
+}
+
+// startRequest prepares the output of the request sent on the stream.
+func (c *client) startRequest(req *clientRequest, streamID uint64) error {
+	if !c.discard {
+		err := req.open(c.outDir)
+		if err != nil {
+			return err
+		}
+	}
+	req.streamID = streamID
+	c.streams[streamID] = req
+	c.sent++
+	return nil
+}
+
+// wake interrupts waiting for packets so that the application can handle
+// events from other goroutines. It can be called concurrently with connect.
+func (c *client) wake() {
+	atomic.StoreInt32(&c.woken, 1)
+	c.socket.SetReadDeadline(time.Now())
 }
 
 func (c *client) readDeadline() time.Time {
+	if atomic.SwapInt32(&c.woken, 0) != 0 {
+		return time.Now()
+	}
+	var deadline time.Time
+	// Negative timeout means there is no timer.
 	timeout := c.conn.Timeout()
-	if timeout > 0 {
-		return time.Now().Add(timeout)
+	if timeout >= 0 {
+		deadline = time.Now().Add(timeout)
 	}
-	return time.Time{}
+	if c.sampler != nil {
+		if d := c.sampler.Deadline(); !d.IsZero() && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+	}
+	return deadline
 }
 
 func (c *client) recv(buf []byte) error {
@@ -103,10 +366,16 @@ func (c *client) recv(buf []byte) error {
 		return err
 	}
 	n, err := c.socket.Read(buf)
+	if err == nil {
+		capture(c.pcap, c.socket.RemoteAddr(), c.socket.LocalAddr(), buf[:n])
+	}
 	if err != nil {
 		if err, ok := err.(net.Error); ok && err.Timeout() {
-			log.Print("timed out")
-			c.conn.OnTimeout()
+			// The deadline might have been set by wake.
+			if c.conn.Timeout() == 0 {
+				log.Print("timed out")
+				c.conn.OnTimeout()
+			}
 			return nil
 		}
 		return err
@@ -118,21 +387,85 @@ func (c *client) recv(buf []byte) error {
 	return err
 }
 
-func (c *client) recvStream(buf []byte) {
+func (c *client) recvStream() {
+	b := buffers.Get()
+	defer buffers.Put(b)
+	buf := b.B
 	for {
 		id, ok := c.conn.ReadableNext()
 		if !ok {
-			return
+			break
 		}
-		n, fin, err := c.conn.StreamRecv(id, buf)
-		if err != nil {
-			log.Printf("stream %d recv failed: %v", id, err)
-			continue
+		req := c.streams[id]
+		for {
+			n, fin, err := c.conn.StreamRecv(id, buf)
+			if err == quiche.ErrDone {
+				break
+			}
+			if err != nil {
+				// The server resets the stream when the request failed.
+				log.Printf("stream %d recv failed: %v", id, err)
+				c.finish(req, err)
+				break
+			}
+			log.Printf("stream %d has %d bytes (fin=%v)", id, n, fin)
+			if req == nil {
+				continue
+			}
+			err = req.write(buf[:n])
+			if err != nil {
+				c.finish(req, err)
+				break
+			}
+			if fin {
+				c.finish(req, nil)
+				break
+			}
 		}
-		log.Printf("stream %d has %d bytes (fin=%v)\n%s", id, n, fin, buf[:n])
-		if id == httpRequestStreamID {
-			log.Print("response received, closing...")
-			c.conn.Close(true, 0x00, []byte("bye"))
+	}
+	c.closeIfDone()
+}
+
+func (c *client) closeIfDone() {
+	if c.completed == len(c.requests) && len(c.streams) == 0 {
+		if c.finished == 0 {
+			c.finished = time.Since(c.start)
+		}
+		log.Print("all responses received, closing...")
+		c.conn.CloseApplication(appNoError, "bye")
+	}
+}
+
+// finish completes the request and writes responses in order to stdout
+// if output directory is not specified.
+func (c *client) finish(req *clientRequest, err error) {
+	if req == nil || req.done {
+		return
+	}
+	delete(c.streams, req.streamID)
+	c.completed++
+	cerr := req.close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		err = fmt.Errorf("%s: %v", req.url, err)
+		log.Print(err)
+		if c.err == nil {
+			c.err = err
+		}
+		// Do not write incomplete response.
+		req.body = nil
+		req.remove()
+	} else {
+		log.Printf("stream %d response received: %s", req.streamID, req.url)
+	}
+	for c.flushed < len(c.requests) && c.requests[c.flushed].done {
+		r := c.requests[c.flushed]
+		c.flushed++
+		if r.file == nil && r.body != nil {
+			os.Stdout.Write(r.body.Bytes())
+			r.body = nil
 		}
 	}
 }
@@ -146,6 +479,7 @@ func (c *client) send(buf []byte) error {
 		if err != nil {
 			return err
 		}
+		capture(c.pcap, c.socket.LocalAddr(), c.socket.RemoteAddr(), buf[:n])
 		n, err = c.socket.Write(buf[:n])
 		if err != nil {
 			return err
@@ -156,22 +490,110 @@ func (c *client) send(buf []byte) error {
 func clientCommand(args []string) error {
 	cmd := flag.NewFlagSet("client", flag.ExitOnError)
 	verbose := cmd.Bool("v", false, "enable debug logging")
+	http3 := cmd.Bool("http3", false, "use HTTP/3 instead of HTTP/0.9")
+	modeName := cmd.String("mode", "http", "application protocol: http, echo or discard")
+	streams := cmd.Int("streams", 1, "number of streams in echo or discard mode")
+	size := cmd.Int64("size", 1000000, "number of bytes to send on each stream in echo or discard mode")
 	wireVersion := cmd.Uint("wire-version", quiche.ProtocolVersion, "the version number to send to the server")
 	noVerify := cmd.Bool("no-verify", false, "don't verify server's certificate")
-	serverAddr := cmd.String("url", "127.0.0.1:4433", "QUIC server address")
+	keyLog := cmd.String("keylog", "", "append TLS secrets to file in NSS key log format (default $SSLKEYLOGFILE)")
+	pcapFile := cmd.String("pcap", "", "write sent and received datagrams to file in pcapng format")
+	qlogDir := cmd.String("qlog", "", "directory to write connection traces to in qlog format")
+	statsInterval := cmd.Duration("stats-interval", 0, "interval to sample connection statistics (0 disables sampling)")
+	statsDir := cmd.String("stats-dir", "", "directory to write sampled statistics to instead of logging them")
+	statsFormat := cmd.String("stats-format", "csv", "format of sampled statistics files: csv or json")
+	outDir := cmd.String("o", "", "directory to write response bodies to instead of stdout")
+	cmd.Usage = func() {
+		fmt.Fprintln(cmd.Output(), "Usage: quiche client [options] URL...")
+		fmt.Fprintln(cmd.Output(), "       quiche client -mode (echo|discard) [options] HOST:PORT")
+		cmd.PrintDefaults()
+	}
 	cmd.Parse(args)
 
+	mode, err := parseAppMode(*modeName)
+	if err != nil {
+		return err
+	}
+	if *pcapFile != "" {
+		var f *os.File
+		clientPcap, f, err = createPcap(*pcapFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	clientQlogDir = *qlogDir
+	err = parseStatsFormat(*statsFormat)
+	if err != nil {
+		return err
+	}
+	clientStats = statsOptions{
+		interval: *statsInterval,
+		dir:      *statsDir,
+		format:   *statsFormat,
+	}
+	if mode != modeHTTP {
+		if cmd.NArg() != 1 || *http3 || *streams < 1 || *size < 0 {
+			cmd.Usage()
+			return fmt.Errorf("invalid arguments in %s mode", *modeName)
+		}
+		if *verbose {
+			quiche.EnableDebugLogging()
+		}
+		config, err := newConfig(uint32(*wireVersion), false)
+		if err != nil {
+			return err
+		}
+		defer config.Free()
+		if *noVerify {
+			config.VerifyPeer(false)
+		}
+		err = setupKeyLog(config, *keyLog)
+		if err != nil {
+			return err
+		}
+		err = config.SetApplicationProtos(mode.applicationProtos())
+		if err != nil {
+			return err
+		}
+		return connectEcho(config, cmd.Arg(0), newEchoClient(mode, *streams, *size))
+	}
+	if cmd.NArg() == 0 {
+		cmd.Usage()
+		return errors.New("no URL given")
+	}
+	urls := make([]*url.URL, cmd.NArg())
+	for i, arg := range cmd.Args() {
+		u, err := url.Parse(arg)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("unsupported URL: %s", arg)
+		}
+		urls[i] = u
+	}
+
 	if *verbose {
 		quiche.EnableDebugLogging()
 	}
-	config, err := newConfig(uint32(*wireVersion))
+	config, err := newConfig(uint32(*wireVersion), *http3)
 	if err != nil {
 		return err
 	}
+	defer config.Free()
 	if *noVerify {
 		config.VerifyPeer(false)
 	}
-	defer config.Free()
+	err = setupKeyLog(config, *keyLog)
+	if err != nil {
+		return err
+	}
 
-	return connect(config, *serverAddr)
+	var h3config *quiche.H3Config
+	if *http3 {
+		h3config = newH3Config()
+		defer h3config.Free()
+	}
+	return fetch(config, h3config, urls, *outDir)
 }
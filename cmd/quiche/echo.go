@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/goburrow/quiche"
+)
+
+// appMode is the application protocol run over QUIC streams.
+type appMode int
+
+const (
+	modeHTTP appMode = iota
+	// modeEcho echoes data of each stream back to the peer, including FIN.
+	modeEcho
+	// modeDiscard reads and ignores data of each stream, then finishes the
+	// stream without data.
+	modeDiscard
+	// modeTunnel maps streams to TCP connections. It is only used by the
+	// tunnel command.
+	modeTunnel
+	// modeSocks is modeTunnel where each stream carries its target address.
+	modeSocks
+)
+
+func parseAppMode(s string) (appMode, error) {
+	switch s {
+	case "http":
+		return modeHTTP, nil
+	case "echo":
+		return modeEcho, nil
+	case "discard":
+		return modeDiscard, nil
+	default:
+		return 0, fmt.Errorf("invalid mode: %s", s)
+	}
+}
+
+// applicationProtos returns ALPN tokens in wire format of modes other than HTTP.
+func (m appMode) applicationProtos() []byte {
+	switch m {
+	case modeEcho:
+		return []byte("\x04echo")
+	case modeDiscard:
+		return []byte("\x07discard")
+	case modeTunnel:
+		return []byte("\x06tunnel")
+	case modeSocks:
+		return []byte("\x05socks")
+	default:
+		return nil
+	}
+}
+
+// maxEchoPending is the maximum data buffered for each echo stream. The server
+// stops reading the stream when the peer does not accept its echo.
+const maxEchoPending = 64 * 1024
+
+// echoStream is state of a server stream in echo or discard mode.
+type echoStream struct {
+	// pending is data received which has not been echoed.
+	pending []byte
+	finRecv bool
+	done    bool
+	// blocked is whether reading stopped because maxEchoPending was reached.
+	// The stream is not readable again until the peer sends more data, so it
+	// is resumed by respond.
+	blocked bool
+}
+
+// recvEcho reads readable streams and echoes or discards their data.
+func (s *server) recvEcho(c *serverConn) {
+	for {
+		id, ok := c.conn.ReadableNext()
+		if !ok {
+			return
+		}
+		st, ok := c.echoes[id]
+		if !ok {
+			st = &echoStream{}
+			c.echoes[id] = st
+		} else if st.blocked {
+			continue
+		}
+		s.readEcho(c, id, st)
+	}
+}
+
+// readEcho reads the stream until maxEchoPending is reached and echoes or
+// discards its data.
+func (s *server) readEcho(c *serverConn, id uint64, st *echoStream) {
+	b := buffers.Get()
+	defer buffers.Put(b)
+	buf := b.B
+	st.blocked = false
+	for !st.finRecv {
+		if len(st.pending) >= maxEchoPending {
+			st.blocked = true
+			break
+		}
+		n, fin, err := c.conn.StreamRecv(id, buf)
+		if err == quiche.ErrDone {
+			break
+		}
+		if err != nil {
+			log.Printf("stream %d recv failed: %v", id, err)
+			break
+		}
+		log.Printf("stream %d has %d bytes (fin=%v)", id, n, fin)
+		st.finRecv = fin
+		if s.mode == modeEcho && id&0x3 == 0 {
+			st.pending = append(st.pending, buf[:n]...)
+		}
+	}
+	s.writeEcho(c, id, st)
+}
+
+func (s *server) writeEcho(c *serverConn, id uint64, st *echoStream) {
+	if id&0x3 != 0 {
+		// Streams initiated by the server or unidirectional are only read.
+		st.done = st.finRecv
+	}
+	for !st.done && (len(st.pending) > 0 || st.finRecv) {
+		n, err := c.conn.StreamSend(id, st.pending, st.finRecv)
+		if err == quiche.ErrDone {
+			break
+		}
+		if err != nil {
+			log.Printf("stream %d send failed: %v", id, err)
+			st.done = true
+			c.conn.StreamShutdown(id, quiche.ShutdownWrite, 0)
+			break
+		}
+		st.pending = append(st.pending[:0], st.pending[n:]...)
+		if len(st.pending) > 0 {
+			// Blocked by flow control.
+			break
+		}
+		st.done = st.finRecv
+	}
+	if st.done {
+		delete(c.echoes, id)
+	}
+}
+
+// patternByte is the payload byte at offset off of stream id sent by the client.
+func patternByte(id uint64, off int64) byte {
+	return byte((uint64(off) + id) % 251)
+}
+
+// echoClient sends patterned payloads on streams and verifies data sent back
+// by the server in echo or discard mode.
+type echoClient struct {
+	mode    appMode
+	streams int
+	size    int64
+
+	// opened is the number of streams started. The rest are queued until
+	// the server allows more streams.
+	opened       int
+	nextStreamID uint64
+	active       map[uint64]*echoClientStream
+	completed    int
+	// err is the first stream failure.
+	err error
+}
+
+type echoClientStream struct {
+	sent     int64
+	finSent  bool
+	received int64
+}
+
+func newEchoClient(mode appMode, streams int, size int64) *echoClient {
+	return &echoClient{
+		mode:         mode,
+		streams:      streams,
+		size:         size,
+		nextStreamID: httpRequestStreamID,
+		active:       make(map[uint64]*echoClientStream),
+	}
+}
+
+// start does nothing as streams are opened by poll.
+func (e *echoClient) start(conn *quiche.TracedConnection) {
+}
+
+// open starts queued streams until the server's stream limit is reached.
+func (e *echoClient) open(conn *quiche.TracedConnection, buf []byte) {
+	for e.opened < e.streams {
+		id := e.nextStreamID
+		st := &echoClientStream{}
+		e.active[id] = st
+		if !e.write(conn, id, st, buf) {
+			// Opened when the server allows more streams.
+			delete(e.active, id)
+			return
+		}
+		e.opened++
+		e.nextStreamID += 4
+	}
+}
+
+// poll sends payloads as allowed by flow control and verifies received data.
+func (e *echoClient) poll(conn *quiche.TracedConnection) {
+	b := buffers.Get()
+	defer buffers.Put(b)
+	buf := b.B
+	for id, st := range e.active {
+		if !st.finSent {
+			e.write(conn, id, st, buf)
+		}
+	}
+	e.open(conn, buf)
+	for {
+		id, ok := conn.ReadableNext()
+		if !ok {
+			break
+		}
+		st := e.active[id]
+		for st != nil {
+			n, fin, err := conn.StreamRecv(id, buf)
+			if err == quiche.ErrDone {
+				break
+			}
+			if err != nil {
+				e.finish(id, err)
+				break
+			}
+			log.Printf("stream %d has %d bytes (fin=%v)", id, n, fin)
+			err = e.verify(id, st, buf[:n], fin)
+			if err != nil || fin {
+				e.finish(id, err)
+				break
+			}
+		}
+	}
+	if e.completed == e.streams {
+		log.Print("all streams completed, closing...")
+		conn.CloseApplication(appNoError, "bye")
+	}
+}
+
+// write sends the payload of the stream as allowed by flow control. It returns
+// false if the stream can not be opened yet because of the stream limit.
+func (e *echoClient) write(conn *quiche.TracedConnection, id uint64, st *echoClientStream, buf []byte) bool {
+	for !st.finSent {
+		b := buf
+		if remaining := e.size - st.sent; int64(len(b)) > remaining {
+			b = b[:remaining]
+		}
+		for i := range b {
+			b[i] = patternByte(id, st.sent+int64(i))
+		}
+		fin := st.sent+int64(len(b)) == e.size
+		n, err := conn.StreamSend(id, b, fin)
+		if err == quiche.ErrDone {
+			return true
+		}
+		if err != nil {
+			if st.sent == 0 && errors.Is(err, quiche.ErrStreamLimit) {
+				return false
+			}
+			e.finish(id, err)
+			return true
+		}
+		st.sent += int64(n)
+		if n < len(b) {
+			// Blocked by flow control.
+			return true
+		}
+		st.finSent = fin
+	}
+	return true
+}
+
+func (e *echoClient) verify(id uint64, st *echoClientStream, b []byte, fin bool) error {
+	if e.mode == modeDiscard {
+		if len(b) > 0 {
+			return fmt.Errorf("unexpected %d bytes in discard mode", len(b))
+		}
+	}
+	for i, c := range b {
+		if c != patternByte(id, st.received+int64(i)) {
+			return fmt.Errorf("data mismatch at offset %d", st.received+int64(i))
+		}
+	}
+	st.received += int64(len(b))
+	if st.received > st.sent {
+		return fmt.Errorf("received %d bytes more than sent", st.received-st.sent)
+	}
+	if fin && e.mode == modeEcho && st.received != e.size {
+		return fmt.Errorf("stream finished after %d of %d bytes", st.received, e.size)
+	}
+	return nil
+}
+
+func (e *echoClient) finish(id uint64, err error) {
+	if _, ok := e.active[id]; !ok {
+		return
+	}
+	delete(e.active, id)
+	e.completed++
+	if err != nil {
+		err = fmt.Errorf("stream %d: %v", id, err)
+		log.Print(err)
+		if e.err == nil {
+			e.err = err
+		}
+	} else {
+		log.Printf("stream %d completed", id)
+	}
+}
+
+// closed returns the result when the connection has been closed.
+func (e *echoClient) closed() error {
+	if e.completed < e.streams {
+		return fmt.Errorf("connection closed with %d of %d streams incomplete",
+			e.streams-e.completed, e.streams)
+	}
+	return e.err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileServer serves files in a root directory.
+type fileServer struct {
+	// root is an absolute path with symbolic links evaluated.
+	root     string
+	listDirs bool
+}
+
+func newFileServer(root string, listDirs bool) (*fileServer, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &fileServer{
+		root:     root,
+		listDirs: listDirs,
+	}, nil
+}
+
+// fileResponse is either content of the requested file or an error message.
+type fileResponse struct {
+	status      int
+	contentType string
+	length      int64
+	body        io.ReadCloser
+}
+
+func errorResponse(status int) *fileResponse {
+	msg := fmt.Sprintf("%d %s\r\n", status, http.StatusText(status))
+	return &fileResponse{
+		status:      status,
+		contentType: "text/plain; charset=utf-8",
+		length:      int64(len(msg)),
+		body:        ioutil.NopCloser(strings.NewReader(msg)),
+	}
+}
+
+// get returns the file at target path.
+func (s *fileServer) get(target string) *fileResponse {
+	resp, err := s.open(target)
+	if err != nil {
+		log.Printf("GET %s: %v", target, err)
+		switch {
+		case os.IsNotExist(err):
+			return errorResponse(http.StatusNotFound)
+		case os.IsPermission(err):
+			return errorResponse(http.StatusForbidden)
+		default:
+			return errorResponse(http.StatusInternalServerError)
+		}
+	}
+	log.Printf("GET %s", target)
+	return resp
+}
+
+func (s *fileServer) open(target string) (*fileResponse, error) {
+	if i := strings.IndexAny(target, "?#"); i >= 0 {
+		target = target[:i]
+	}
+	p, err := url.PathUnescape(target)
+	if err != nil || !strings.HasPrefix(p, "/") || strings.IndexByte(p, 0) >= 0 {
+		return nil, os.ErrNotExist
+	}
+	// Cleaning a rooted path removes all ".." elements.
+	name := filepath.Join(s.root, filepath.FromSlash(path.Clean(p)))
+	// The file is opened before its path is checked so that a symbolic link
+	// replaced after the check can not escape root.
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		err = s.checkInRoot(name, fi)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.IsDir() {
+		contentType := mime.TypeByExtension(filepath.Ext(name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		return &fileResponse{
+			status:      http.StatusOK,
+			contentType: contentType,
+			length:      fi.Size(),
+			body:        f,
+		}, nil
+	}
+	defer f.Close()
+	if !s.listDirs {
+		return nil, os.ErrPermission
+	}
+	return listDir(f)
+}
+
+// checkInRoot returns an error if name resolves to a file outside of root or
+// to a file other than the opened one.
+func (s *fileServer) checkInRoot(name string, opened os.FileInfo) error {
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(s.root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		// Symbolic link to outside of root.
+		return os.ErrPermission
+	}
+	fi, err := os.Stat(resolved)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(opened, fi) {
+		// Path was changed after the file was opened.
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func listDir(f *os.File) (*fileResponse, error) {
+	files, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	var b bytes.Buffer
+	for _, fi := range files {
+		b.WriteString(fi.Name())
+		if fi.IsDir() {
+			b.WriteByte('/')
+		}
+		b.WriteString("\r\n")
+	}
+	return &fileResponse{
+		status:      http.StatusOK,
+		contentType: "text/plain; charset=utf-8",
+		length:      int64(b.Len()),
+		body:        ioutil.NopCloser(&b),
+	}, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quiche")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	err = os.Mkdir(root, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("s"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join(dir, "secret"), filepath.Join(root, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		root   string
+		target string
+		status int
+	}{
+		{root, "/a.txt", http.StatusOK},
+		{root, "/../secret", http.StatusNotFound},
+		{root, "/link", http.StatusForbidden},
+		{root, "/missing", http.StatusNotFound},
+		{root, "/", http.StatusForbidden},
+		// Every file is inside the file system root.
+		{"/", filepath.ToSlash(filepath.Join(root, "a.txt")), http.StatusOK},
+		{"/", filepath.ToSlash(filepath.Join(root, "link")), http.StatusOK},
+	}
+	for _, tt := range tests {
+		s, err := newFileServer(tt.root, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := s.get(tt.target)
+		resp.body.Close()
+		if resp.status != tt.status {
+			t.Fatalf("%s %s: unexpected status: want %d, actual %d", tt.root, tt.target, tt.status, resp.status)
+		}
+	}
+
+	// The file replaced after being opened is not served.
+	s, err := newFileServer(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(root, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.checkInRoot(root, fi)
+	if !os.IsPermission(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/goburrow/quiche"
+)
+
+// maxRequestLen is the maximum length of an HTTP/0.9 request line.
+const maxRequestLen = 1024
+
+// serveHTTP09 parses the HTTP/0.9 request line and returns the response.
+// HTTP/0.9 has no status line so errors are sent by resetting the stream
+// with the status as the error code instead of the response body.
+func serveHTTP09(h handler, request []byte) *fileResponse {
+	line := request
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(string(line))
+	if len(line) > maxRequestLen || len(fields) != 2 || fields[0] != "GET" {
+		return errorResponse(http.StatusBadRequest)
+	}
+	return h.get(fields[1])
+}
+
+// serverStream is state of an HTTP/0.9 or HTTP/3 request stream.
+type serverStream struct {
+	request []byte
+	// finRecv is whether the client has finished sending on the stream.
+	finRecv bool
+
+	// body is nil until the request is complete.
+	body  io.ReadCloser
+	chunk *quiche.Buffer
+	// pending is data read from body which has not been accepted by the stream.
+	pending []byte
+	eof     bool
+	done    bool
+}
+
+// appendRequest buffers request data and returns true when the request line
+// is complete.
+func (st *serverStream) appendRequest(b []byte, fin bool) bool {
+	st.finRecv = st.finRecv || fin
+	if st.body != nil || st.done {
+		// Ignore data after the request line.
+		return false
+	}
+	st.request = append(st.request, b...)
+	return fin || bytes.IndexByte(st.request, '\n') >= 0 || len(st.request) > maxRequestLen
+}
+
+func (st *serverStream) respond(body io.ReadCloser) {
+	st.request = nil
+	st.body = body
+	st.chunk = buffers.Get()
+}
+
+// write sends as much of the response body as flow control allows.
+func (st *serverStream) write(send func(b []byte, fin bool) (int, error)) error {
+	for !st.done {
+		if len(st.pending) == 0 && !st.eof {
+			n, err := st.body.Read(st.chunk.B)
+			st.pending = st.chunk.B[:n]
+			if err == io.EOF {
+				st.eof = true
+			} else if err != nil {
+				return err
+			} else if n == 0 {
+				continue
+			}
+		}
+		n, err := send(st.pending, st.eof)
+		if err == quiche.ErrDone {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		st.pending = st.pending[n:]
+		if len(st.pending) > 0 {
+			// Blocked by flow control.
+			return nil
+		}
+		st.done = st.eof
+	}
+	return nil
+}
+
+// close releases the response body.
+func (st *serverStream) close() {
+	if st.body != nil {
+		st.body.Close()
+		st.body = nil
+		buffers.Put(st.chunk)
+		st.chunk = nil
+		st.pending = nil
+	}
+}
+
+// clientRequest is an HTTP/0.9 or HTTP/3 request and its response.
+type clientRequest struct {
+	url      *url.URL
+	streamID uint64
+	// status is only available in HTTP/3.
+	status int
+	// Response body is written to file if output directory is given,
+	// otherwise buffered in body. Both are nil if the response is discarded.
+	file     *os.File
+	body     *bytes.Buffer
+	received int64
+	done     bool
+}
+
+func (r *clientRequest) line() []byte {
+	return []byte("GET " + r.url.RequestURI() + "\r\n")
+}
+
+// outputName returns the name of the file the response body of u is written to.
+func outputName(u *url.URL) string {
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		name = "index.html"
+	}
+	return name
+}
+
+// checkOutputNames returns an error if responses of two URLs would be
+// written to the same file.
+func checkOutputNames(urls []*url.URL) error {
+	names := make(map[string]*url.URL, len(urls))
+	for _, u := range urls {
+		name := outputName(u)
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("%s and %s would both be written to %s", other, u, name)
+		}
+		names[name] = u
+	}
+	return nil
+}
+
+// open creates the output file in dir, or the body buffer when dir is empty.
+func (r *clientRequest) open(dir string) error {
+	if dir == "" {
+		r.body = &bytes.Buffer{}
+		return nil
+	}
+	f, err := os.Create(filepath.Join(dir, outputName(r.url)))
+	if err != nil {
+		return err
+	}
+	r.file = f
+	return nil
+}
+
+func (r *clientRequest) write(b []byte) error {
+	r.received += int64(len(b))
+	if r.file != nil {
+		_, err := r.file.Write(b)
+		return err
+	}
+	if r.body != nil {
+		r.body.Write(b)
+	}
+	return nil
+}
+
+// remove deletes the output file of a failed request.
+func (r *clientRequest) remove() {
+	if r.file != nil {
+		os.Remove(r.file.Name())
+	}
+}
+
+func (r *clientRequest) close() error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+	if r.file != nil {
+		return r.file.Close()
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/goburrow/quiche"
+)
+
+func h3Header(name, value string) quiche.H3Header {
+	return quiche.H3Header{
+		Name:  []byte(name),
+		Value: []byte(value),
+	}
+}
+
+// pollH3 processes HTTP/3 events of the server connection.
+func (s *server) pollH3(c *serverConn) {
+	if c.h3 == nil {
+		c.h3 = quiche.H3Accept(c.conn.Connection, s.h3config)
+		if c.h3 == nil {
+			log.Printf("%s failed to create HTTP/3 connection", c.addr)
+			c.conn.CloseWithError(quiche.InternalError, "fail")
+			return
+		}
+	}
+	for {
+		id, ev, err := c.h3.Poll(c.conn.Connection)
+		if err == quiche.ErrDone {
+			return
+		}
+		if err != nil {
+			log.Printf("%s HTTP/3 poll failed: %v", c.addr, err)
+			c.conn.CloseWithError(quiche.InternalError, "fail")
+			return
+		}
+		switch ev.Type() {
+		case quiche.H3EventHeaders:
+			s.h3Request(c, id, ev.Headers())
+		case quiche.H3EventData:
+			s.h3Discard(c, id)
+		case quiche.H3EventFinished:
+			if st, ok := c.streams[id]; ok {
+				st.finRecv = true
+				s.writeStream(c, id, st)
+			}
+		}
+		ev.Free()
+	}
+}
+
+func (s *server) h3Request(c *serverConn, id uint64, headers []quiche.H3Header) {
+	var method, target string
+	for _, h := range headers {
+		switch string(h.Name) {
+		case ":method":
+			method = string(h.Value)
+		case ":path":
+			target = string(h.Value)
+		}
+	}
+	var resp *fileResponse
+	switch {
+	case target == "":
+		resp = errorResponse(http.StatusBadRequest)
+	case method != "GET":
+		resp = errorResponse(http.StatusMethodNotAllowed)
+	default:
+		resp = s.handler.get(target)
+	}
+	err := c.h3.SendResponse(c.conn.Connection, id, []quiche.H3Header{
+		h3Header(":status", strconv.Itoa(resp.status)),
+		h3Header("server", "quiche-go"),
+		h3Header("content-type", resp.contentType),
+		h3Header("content-length", strconv.FormatInt(resp.length, 10)),
+	}, false)
+	if err != nil {
+		log.Printf("stream %d send response failed: %v", id, err)
+		resp.body.Close()
+		return
+	}
+	st := &serverStream{}
+	st.respond(resp.body)
+	c.streams[id] = st
+	s.writeStream(c, id, st)
+}
+
+// h3Discard reads and ignores request body.
+func (s *server) h3Discard(c *serverConn, id uint64) {
+	b := buffers.Get()
+	defer buffers.Put(b)
+	for {
+		_, err := c.h3.RecvBody(c.conn.Connection, id, b.B)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sendH3Requests sends queued HTTP/3 requests until the server's stream
+// limit is reached.
+func (c *client) sendH3Requests() error {
+	for c.sent < len(c.requests) {
+		req := c.requests[c.sent]
+		headers := []quiche.H3Header{
+			h3Header(":method", "GET"),
+			h3Header(":scheme", req.url.Scheme),
+			h3Header(":authority", req.url.Host),
+			h3Header(":path", req.url.RequestURI()),
+			h3Header("user-agent", "quiche-go"),
+		}
+		id, err := c.h3.SendRequest(c.conn.Connection, headers, true)
+		if errors.Is(err, quiche.H3ErrTransport) || quiche.IsTemporary(err) {
+			// The transport error is most likely the stream limit, so the
+			// request is sent when the server allows more streams.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("stream %d sent request: GET %s", id, req.url)
+		err = c.startRequest(req, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pollH3 processes HTTP/3 events of the client connection.
+func (c *client) pollH3() {
+	b := buffers.Get()
+	defer buffers.Put(b)
+	for {
+		id, ev, err := c.h3.Poll(c.conn.Connection)
+		if err == quiche.ErrDone {
+			break
+		}
+		if err != nil {
+			log.Printf("HTTP/3 poll failed: %v", err)
+			c.conn.CloseWithError(quiche.InternalError, "fail")
+			return
+		}
+		req := c.streams[id]
+		switch ev.Type() {
+		case quiche.H3EventHeaders:
+			c.h3Response(req, ev.Headers())
+		case quiche.H3EventData:
+			for {
+				n, err := c.h3.RecvBody(c.conn.Connection, id, b.B)
+				if err == quiche.ErrDone {
+					break
+				}
+				if err != nil {
+					c.finish(req, err)
+					break
+				}
+				if req != nil {
+					err = req.write(b.B[:n])
+					if err != nil {
+						c.finish(req, err)
+						break
+					}
+				}
+			}
+		case quiche.H3EventFinished:
+			var err error
+			if req != nil && req.status >= 400 {
+				err = fmt.Errorf("response status %d", req.status)
+			}
+			c.finish(req, err)
+		}
+		ev.Free()
+	}
+	c.closeIfDone()
+}
+
+// h3Response prints response status and headers to stderr unless the client discards responses.
+func (c *client) h3Response(req *clientRequest, headers []quiche.H3Header) {
+	if req == nil {
+		return
+	}
+	if !c.discard {
+		fmt.Fprintf(os.Stderr, "< %s\n", req.url)
+	}
+	for _, h := range headers {
+		if string(h.Name) == ":status" {
+			status, err := strconv.Atoi(string(h.Value))
+			if err != nil {
+				c.finish(req, errors.New("invalid response status"))
+				return
+			}
+			req.status = status
+		}
+		if !c.discard {
+			fmt.Fprintf(os.Stderr, "< %s: %s\n", h.Name, h.Value)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/goburrow/quiche"
+)
+
+// Exit code of the interop endpoint for test cases it does not implement.
+const interopUnsupportedExitCode = 127
+
+// errUnsupportedTestCase is returned by the interop endpoint for test cases
+// it does not implement.
+var errUnsupportedTestCase = errors.New("unsupported test case")
+
+// interopTestCase configures the endpoint for a test case of the QUIC
+// interop runner.
+type interopTestCase struct {
+	retry retryMode
+}
+
+func parseInteropTestCase(name string) (*interopTestCase, error) {
+	switch name {
+	case "handshake", "transfer", "multiplexing":
+		return &interopTestCase{retry: retryNever}, nil
+	case "retry":
+		return &interopTestCase{retry: retryAlways}, nil
+	default:
+		// Includes resumption and keyupdate, which the library does not support.
+		return nil, fmt.Errorf("%w: %s", errUnsupportedTestCase, name)
+	}
+}
+
+// interopCommand runs the client or server as specified by the environment
+// variables of the interop runner:
+//
+//	ROLE           client or server
+//	TESTCASE       name of the test case
+//	REQUESTS       space-separated URLs the client downloads
+//	SSLKEYLOGFILE  file to log TLS secrets to
+//	QLOGDIR        directory to write qlog files to
+//
+// The client writes downloaded files to /downloads and the server serves
+// files from /www with the certificate in /certs.
+func interopCommand(args []string) error {
+	cmd := flag.NewFlagSet("interop", flag.ExitOnError)
+	verbose := cmd.Bool("v", false, "enable debug logging")
+	listenAddr := cmd.String("listen", "[::]:443", "listen on the given IP:port in server role")
+	wwwDir := cmd.String("www", "/www", "root directory of the server")
+	downloadDir := cmd.String("downloads", "/downloads", "directory to write downloaded files to")
+	certDir := cmd.String("certs", "/certs", "directory containing cert.pem and priv.key")
+	cmd.Usage = func() {
+		fmt.Fprintln(cmd.Output(), "Usage: ROLE=(client|server) TESTCASE=name quiche interop [options]")
+		cmd.PrintDefaults()
+	}
+	cmd.Parse(args)
+
+	role := os.Getenv("ROLE")
+	if role != "client" && role != "server" {
+		cmd.Usage()
+		return fmt.Errorf("invalid role: %q", role)
+	}
+	testCase, err := parseInteropTestCase(os.Getenv("TESTCASE"))
+	if err != nil {
+		return err
+	}
+	if *verbose {
+		quiche.EnableDebugLogging()
+	}
+	config, err := newConfig(quiche.ProtocolVersion, false)
+	if err != nil {
+		return err
+	}
+	defer config.Free()
+	err = setupKeyLog(config, "")
+	if err != nil {
+		return err
+	}
+	qlogDir := os.Getenv("QLOGDIR")
+	if qlogDir != "" {
+		err = os.MkdirAll(qlogDir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	if role == "client" {
+		return interopClient(config, qlogDir, *downloadDir)
+	}
+	return interopServer(config, testCase, qlogDir, *listenAddr, *wwwDir, *certDir)
+}
+
+func interopClient(config *quiche.Config, qlogDir, downloadDir string) error {
+	var urls []*url.URL
+	for _, s := range strings.Fields(os.Getenv("REQUESTS")) {
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		if u.Host == "" {
+			return fmt.Errorf("unsupported URL: %s", s)
+		}
+		urls = append(urls, u)
+	}
+	if len(urls) == 0 {
+		return errors.New("no requests")
+	}
+	// The interop runner uses certificates which can not be verified.
+	config.VerifyPeer(false)
+	clientQlogDir = qlogDir
+	return fetch(config, nil, urls, downloadDir)
+}
+
+func interopServer(config *quiche.Config, testCase *interopTestCase, qlogDir, listenAddr, wwwDir, certDir string) error {
+	err := loadCertFiles(config, filepath.Join(certDir, "cert.pem"), filepath.Join(certDir, "priv.key"))
+	if err != nil {
+		return err
+	}
+	files, err := newFileServer(wwwDir, false)
+	if err != nil {
+		return err
+	}
+	connIDs, err := quiche.NewRandomConnectionIDGenerator(quiche.MaxConnIDLen)
+	if err != nil {
+		return err
+	}
+	opts := serverOptions{
+		listenAddr: listenAddr,
+		mode:       modeHTTP,
+		handler:    files,
+		limits: serverLimits{
+			retry: testCase.retry,
+		},
+		disableMigration: true,
+		drainTimeout:     time.Second,
+		qlogDir:          qlogDir,
+		connIDs:          connIDs,
+	}
+	return listen(config, nil, &opts)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// rejectReason is the reason why a packet initiating a new connection was rejected.
+type rejectReason int
+
+const (
+	rejectInvalidHeader rejectReason = iota
+	rejectInvalidToken
+	rejectMaxConns
+	rejectMaxHandshakes
+	rejectRateLimited
+	rejectShutdown
+	numRejectReasons
+)
+
+var rejectReasonNames = [...]string{
+	rejectInvalidHeader: "invalid_header",
+	rejectInvalidToken:  "invalid_token",
+	rejectMaxConns:      "max_conns",
+	rejectMaxHandshakes: "max_handshakes",
+	rejectRateLimited:   "rate_limited",
+	rejectShutdown:      "shutdown",
+}
+
+func (r rejectReason) String() string {
+	if r >= 0 && r < numRejectReasons {
+		return rejectReasonNames[r]
+	}
+	return fmt.Sprintf("unknown(%d)", int(r))
+}
+
+// rejectCounters counts rejected packets by reason. It can be read
+// concurrently with the listening loop.
+type rejectCounters [numRejectReasons]uint64
+
+func (c *rejectCounters) add(r rejectReason) {
+	atomic.AddUint64(&c[r], 1)
+}
+
+func (c *rejectCounters) get(r rejectReason) uint64 {
+	return atomic.LoadUint64(&c[r])
+}
+
+func (c *rejectCounters) String() string {
+	var b strings.Builder
+	for r := rejectReason(0); r < numRejectReasons; r++ {
+		if r > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%s=%d", r, c.get(r))
+	}
+	return b.String()
+}
+
+// retryMode determines when the server sends stateless retry to validate
+// client addresses.
+type retryMode int
+
+const (
+	retryAlways retryMode = iota
+	retryNever
+	retryUnderLoad
+)
+
+func parseRetryMode(s string) (retryMode, error) {
+	switch s {
+	case "always":
+		return retryAlways, nil
+	case "never":
+		return retryNever, nil
+	case "load":
+		return retryUnderLoad, nil
+	default:
+		return 0, fmt.Errorf("invalid retry mode: %s", s)
+	}
+}
+
+// serverLimits is admission control for new connections. Zero values mean unlimited.
+type serverLimits struct {
+	maxConns      int
+	maxHandshakes int
+	retry         retryMode
+	// retryLoad is the number of in-progress handshakes from which retry is
+	// required when retry mode is retryUnderLoad.
+	retryLoad int
+	// limiter limits new connections per client address prefix.
+	limiter *rateLimiter
+}
+
+// check returns the reason to reject a new connection given the numbers of
+// active connections and in-progress handshakes.
+func (l *serverLimits) check(conns, handshakes int) (rejectReason, bool) {
+	if l.maxConns > 0 && conns >= l.maxConns {
+		return rejectMaxConns, false
+	}
+	if l.maxHandshakes > 0 && handshakes >= l.maxHandshakes {
+		return rejectMaxHandshakes, false
+	}
+	return 0, true
+}
+
+// needRetry returns true if the client address must be validated with
+// stateless retry given the number of in-progress handshakes.
+func (l *serverLimits) needRetry(handshakes int) bool {
+	switch l.retry {
+	case retryNever:
+		return false
+	case retryUnderLoad:
+		return handshakes >= l.retryLoad
+	default:
+		return true
+	}
+}
+
+// checkPrefixLen validates prefix lengths used to group client addresses.
+func checkPrefixLen(prefix4, prefix6 int) error {
+	if prefix4 < 0 || prefix4 > 32 {
+		return fmt.Errorf("invalid IPv4 prefix length: %d", prefix4)
+	}
+	if prefix6 < 0 || prefix6 > 128 {
+		return fmt.Errorf("invalid IPv6 prefix length: %d", prefix6)
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket rate limiter keyed by client address prefix.
+// It is not safe for concurrent use.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	mask4 net.IPMask
+	mask6 net.IPMask
+
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+// newRateLimiter creates a rate limiter allowing rate connections per second with
+// the given burst for each IPv4 or IPv6 prefix. Prefix lengths must be valid,
+// see checkPrefixLen.
+func newRateLimiter(rate float64, burst int, prefix4, prefix6 int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		mask4:   net.CIDRMask(prefix4, 32),
+		mask6:   net.CIDRMask(prefix6, 128),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of the address and returns false
+// if the bucket is empty.
+func (l *rateLimiter) allow(addr net.Addr, now time.Time) bool {
+	if now.Sub(l.lastPrune) > time.Minute {
+		l.prune(now)
+		l.lastPrune = now
+	}
+	key := l.key(addr)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{
+			tokens: l.burst,
+			last:   now,
+		}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.rate
+	if tokens > l.burst {
+		tokens = l.burst
+	}
+	return tokens
+}
+
+func (l *rateLimiter) key(addr net.Addr) string {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return addr.String()
+	}
+	if ip := udpAddr.IP.To4(); ip != nil {
+		return ip.Mask(l.mask4).String()
+	}
+	return udpAddr.IP.Mask(l.mask6).String()
+}
+
+// prune removes buckets which have been fully refilled.
+func (l *rateLimiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
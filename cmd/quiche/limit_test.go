@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 3, 24, 64)
+	now := time.Unix(1500000000, 0)
+	addr := func(s string) net.Addr {
+		return &net.UDPAddr{IP: net.ParseIP(s), Port: 4433}
+	}
+	tests := []struct {
+		elapsed time.Duration
+		addr    string
+		allowed bool
+	}{
+		// Burst of the prefix.
+		{0, "192.0.2.1", true},
+		{0, "192.0.2.2", true},
+		{0, "192.0.2.3", true},
+		{0, "192.0.2.4", false},
+		// Other prefixes have their own buckets.
+		{0, "192.0.3.1", true},
+		{0, "2001:db8::1", true},
+		{0, "2001:db8::2", true},
+		{0, "2001:db8::3", true},
+		{0, "2001:db8::4", false},
+		{0, "2001:db8:0:1::1", true},
+		// One token is refilled after 500ms at 2 per second.
+		{499 * time.Millisecond, "192.0.2.1", false},
+		{500 * time.Millisecond, "192.0.2.1", true},
+		{500 * time.Millisecond, "192.0.2.1", false},
+		// Refill is capped at the burst.
+		{time.Hour, "192.0.2.1", true},
+		{time.Hour, "192.0.2.1", true},
+		{time.Hour, "192.0.2.1", true},
+		{time.Hour, "192.0.2.1", false},
+	}
+	for i, tt := range tests {
+		allowed := l.allow(addr(tt.addr), now.Add(tt.elapsed))
+		if allowed != tt.allowed {
+			t.Fatalf("%d: %s at %v: want %v, actual %v", i, tt.addr, tt.elapsed, tt.allowed, allowed)
+		}
+	}
+	// Full buckets are pruned.
+	l.allow(addr("192.0.2.1"), now.Add(2*time.Hour))
+	if len(l.buckets) != 1 {
+		t.Fatalf("unexpected buckets: %v", l.buckets)
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	tests := []struct {
+		limits     serverLimits
+		conns      int
+		handshakes int
+		reason     rejectReason
+		ok         bool
+		retry      bool
+	}{
+		{serverLimits{}, 100, 100, 0, true, true},
+		{serverLimits{maxConns: 10}, 9, 9, 0, true, true},
+		{serverLimits{maxConns: 10}, 10, 0, rejectMaxConns, false, true},
+		{serverLimits{maxHandshakes: 5}, 10, 4, 0, true, true},
+		{serverLimits{maxHandshakes: 5}, 10, 5, rejectMaxHandshakes, false, true},
+		{serverLimits{retry: retryNever}, 10, 10, 0, true, false},
+		{serverLimits{retry: retryUnderLoad, retryLoad: 3}, 10, 2, 0, true, false},
+		{serverLimits{retry: retryUnderLoad, retryLoad: 3}, 10, 3, 0, true, true},
+	}
+	for i, tt := range tests {
+		reason, ok := tt.limits.check(tt.conns, tt.handshakes)
+		if reason != tt.reason || ok != tt.ok {
+			t.Fatalf("%d: unexpected check: want %v %v, actual %v %v", i, tt.reason, tt.ok, reason, ok)
+		}
+		retry := tt.limits.needRetry(tt.handshakes)
+		if retry != tt.retry {
+			t.Fatalf("%d: unexpected retry: want %v, actual %v", i, tt.retry, retry)
+		}
+	}
+}
+
+func TestCheckPrefixLen(t *testing.T) {
+	tests := []struct {
+		prefix4, prefix6 int
+		ok               bool
+	}{
+		{32, 64, true},
+		{0, 0, true},
+		{32, 128, true},
+		{33, 64, false},
+		{-1, 64, false},
+		{24, 129, false},
+	}
+	for _, tt := range tests {
+		err := checkPrefixLen(tt.prefix4, tt.prefix6)
+		if (err == nil) != tt.ok {
+			t.Fatalf("%d %d: unexpected error: %v", tt.prefix4, tt.prefix6, err)
+		}
+	}
+}
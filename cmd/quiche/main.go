@@ -1,11 +1,14 @@
 package main
 
 import (
-	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/goburrow/quiche"
@@ -15,10 +18,16 @@ const maxDatagramSize = 1232
 const bufferSize = 2048
 const httpRequestStreamID = 4
 
+// appNoError is the application error code of connections closed normally.
+const appNoError = quiche.ApplicationErrorCode(0)
+
+// buffers is shared by the server, client and their streams.
+var buffers = quiche.NewBufferPool(bufferSize)
+
 func main() {
 	flag.Usage = func() {
 		output := flag.CommandLine.Output()
-		fmt.Fprintln(output, "Usage: quiche (client|server) [options]")
+		fmt.Fprintln(output, "Usage: quiche (client|server|bench|tunnel|gencert|interop) [options] [args]")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
@@ -29,18 +38,34 @@ func main() {
 		err = clientCommand(flag.Args()[1:])
 	case "server":
 		err = serverCommand(flag.Args()[1:])
+	case "bench":
+		err = benchCommand(flag.Args()[1:])
+	case "tunnel":
+		err = tunnelCommand(flag.Args()[1:])
+	case "gencert":
+		err = gencertCommand(flag.Args()[1:])
+	case "interop":
+		err = interopCommand(flag.Args()[1:])
 	default:
 		flag.Usage()
 		os.Exit(2)
 	}
 	if err != nil {
+		if errors.Is(err, errUnsupportedTestCase) {
+			log.Print(err)
+			os.Exit(interopUnsupportedExitCode)
+		}
 		log.Fatal(err)
 	}
 }
 
-func newConfig(version uint32) (*quiche.Config, error) {
+func newConfig(version uint32, http3 bool) (*quiche.Config, error) {
 	config := quiche.NewConfig(version)
-	err := config.SetApplicationProtos([]byte("\x05hq-20\x08http/0.9"))
+	protos := "\x05hq-20\x08http/0.9"
+	if http3 {
+		protos = quiche.H3ApplicationProtocol
+	}
+	err := config.SetApplicationProtos([]byte(protos))
 	if err != nil {
 		config.Free()
 		return nil, err
@@ -50,17 +75,165 @@ func newConfig(version uint32) (*quiche.Config, error) {
 	config.SetInitialMaxData(10000000)
 	config.SetInitialMaxStreamDataBidiLocal(1000000)
 	config.SetInitialMaxStreamDataBidiRemote(1000000)
+	config.SetInitialMaxStreamDataUni(1000000)
 	config.SetInitialMaxStreamsBidi(100)
 	config.SetInitialMaxStreamsUni(100)
 	config.DisableMigration(true)
 	return config, nil
 }
 
-func newConnID() []byte {
-	b := make([]byte, quiche.MaxConnIDLen)
-	_, err := rand.Read(b)
+// setupKeyLog enables logging of TLS secrets to file, or to the file named by
+// SSLKEYLOGFILE if it is set in the environment.
+func setupKeyLog(config *quiche.Config, file string) error {
+	if file == "" {
+		file = os.Getenv(quiche.KeyLogEnv)
+		if file == "" {
+			return nil
+		}
+		config.LogKeys()
+	} else {
+		// Only readable by the owner. It is kept open until the process exits.
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		err = config.LogKeysTo(f)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	log.Printf("WARNING: TLS secrets are logged to %s. Anyone with this file can decrypt the captured traffic.", file)
+	return nil
+}
+
+// createPcap creates file to capture datagrams in pcapng format.
+func createPcap(name string) (*quiche.PcapWriter, *os.File, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	w, err := quiche.NewPcapWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return w, f, nil
+}
+
+// capture writes the datagram sent from src to dst if w is not nil.
+func capture(w *quiche.PcapWriter, src, dst net.Addr, b []byte) {
+	if w == nil {
+		return
+	}
+	srcAddr, _ := src.(*net.UDPAddr)
+	dstAddr, _ := dst.(*net.UDPAddr)
+	err := w.WritePacket(time.Now(), srcAddr, dstAddr, b)
+	if err != nil {
+		log.Printf("capture failed: %v", err)
+	}
+}
+
+// statsSamples is the number of recent stats samples kept for each connection.
+const statsSamples = 3600
+
+// statsOptions configures periodic sampling of connection statistics.
+type statsOptions struct {
+	// interval is zero when sampling is disabled.
+	interval time.Duration
+	// dir is the directory to write samples to when connections are closed.
+	// Samples are logged instead if it is empty.
+	dir string
+	// format is either csv or json.
+	format string
+}
+
+// newSampler returns nil if sampling is disabled.
+func (o *statsOptions) newSampler(id []byte) *quiche.StatsSampler {
+	if o.interval <= 0 {
+		return nil
+	}
+	var onSample func(s *quiche.StatsSample)
+	if o.dir == "" {
+		onSample = func(s *quiche.StatsSample) {
+			log.Printf("%x stats: %v", id, &s.Stats)
+		}
+	}
+	return quiche.NewStatsSampler(o.interval, statsSamples, onSample)
+}
+
+// dump writes samples of the connection to a file in dir named after the
+// connection id and the vantage point.
+func (o *statsOptions) dump(sampler *quiche.StatsSampler, id []byte, vantagePoint string) error {
+	if o.dir == "" {
+		return nil
+	}
+	name := filepath.Join(o.dir, fmt.Sprintf("%x_%s_stats.%s", id, vantagePoint, o.format))
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if o.format == "json" {
+		err = quiche.WriteStatsJSON(f, sampler.Samples())
+	} else {
+		err = quiche.WriteStatsCSV(f, sampler.Samples())
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// parseStatsFormat validates the format of stats files.
+func parseStatsFormat(format string) error {
+	switch format {
+	case "csv", "json":
+		return nil
+	default:
+		return fmt.Errorf("unsupported stats format: %s", format)
+	}
+}
+
+// createQlog creates a qlog file in dir named after the connection id and
+// the vantage point, which is either "client" or "server".
+func createQlog(dir string, id []byte, vantagePoint string) (*quiche.QlogWriter, *os.File, error) {
+	name := filepath.Join(dir, fmt.Sprintf("%x_%s.sqlog", id, vantagePoint))
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	w, err := quiche.NewQlogWriter(f, vantagePoint, id)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return w, f, nil
+}
+
+func newH3Config() *quiche.H3Config {
+	return quiche.NewH3Config(0, 1024, 0, 0)
+}
+
+// newConnIDGenerator returns a random connection ID generator if serverID is empty,
+// otherwise a routable one which is encrypted when key is given.
+func newConnIDGenerator(configID uint, serverID, key string) (quiche.ConnectionIDGenerator, error) {
+	if configID > quiche.MaxConnIDConfigID {
+		return nil, fmt.Errorf("connection ID config is invalid: %d", configID)
+	}
+	if serverID == "" {
+		return quiche.NewRandomConnectionIDGenerator(quiche.MaxConnIDLen)
+	}
+	sid, err := hex.DecodeString(serverID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server ID: %v", err)
+	}
+	if key == "" {
+		return quiche.NewPlaintextConnectionIDGenerator(uint8(configID), sid, quiche.MaxConnIDLen)
+	}
+	k, err := hex.DecodeString(key)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid connection ID key: %v", err)
 	}
-	return b
+	return quiche.NewEncryptedConnectionIDGenerator(uint8(configID), sid, k)
 }
@@ -1,16 +1,29 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"flag"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/goburrow/quiche"
+	"github.com/goburrow/quiche/metrics"
 )
 
 const maxTokenLen = 64
 
+// amplificationFactor limits data sent to an unvalidated peer address to a
+// multiple of data received from it, as for handshakes in QUIC.
+const amplificationFactor = 3
+
 func listenUDP(addr string) (net.PacketConn, error) {
 	localAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
@@ -19,145 +32,564 @@ func listenUDP(addr string) (net.PacketConn, error) {
 	return net.ListenUDP("udp", localAddr)
 }
 
-func listen(config *quiche.Config, listenAddr, root string) error {
-	socket, err := listenUDP(listenAddr)
+// handler returns responses of requested paths.
+type handler interface {
+	get(target string) *fileResponse
+}
+
+type serverOptions struct {
+	listenAddr string
+	mode       appMode
+	handler    handler
+	// tunnelTarget is the TCP address which streams are forwarded to in tunnel mode.
+	// In SOCKS mode, streams carry their target addresses.
+	tunnelTarget     string
+	connIDs          quiche.ConnectionIDGenerator
+	limits           serverLimits
+	disableMigration bool
+	drainTimeout     time.Duration
+	// pcap captures all datagrams if it is not nil.
+	pcap *quiche.PcapWriter
+	// qlogDir is the directory to write connection traces to if it is not empty.
+	qlogDir string
+	// metrics is updated by the server and its connections if it is not nil.
+	metrics *metrics.Metrics
+	stats   statsOptions
+}
+
+func newServer(config *quiche.Config, h3config *quiche.H3Config, opts *serverOptions) (*server, error) {
+	socket, err := listenUDP(opts.listenAddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer socket.Close()
-	s := server{
-		config: config,
-		socket: socket,
-		conns:  make(map[string]serverConn),
+	s := &server{
+		config:   config,
+		h3config: h3config,
+		mode:     opts.mode,
+		handler:  opts.handler,
+		pcap:     opts.pcap,
+		qlogDir:  opts.qlogDir,
+		metrics:  opts.metrics,
+		stats:    opts.stats,
+		connIDs:  opts.connIDs,
+		socket:   socket,
+		conns:    make(map[string]*serverConn),
+		limits:   opts.limits,
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+
+		disableMigration: opts.disableMigration,
+		addrChanged: func(id []byte, oldAddr, newAddr net.Addr) {
+			log.Printf("%s peer address of connection %x changed from %s", newAddr, id, oldAddr)
+		},
+	}
+	if opts.mode == modeTunnel || opts.mode == modeSocks {
+		s.tunnelEvents = make(chan tunnelEvent, tunnelEventsLen)
+		target := opts.tunnelTarget
+		s.tunnelDial = func(addr string) (net.Conn, error) {
+			if target != "" {
+				addr = target
+			}
+			return net.DialTimeout("tcp", addr, tunnelDialTimeout)
+		}
 	}
-	log.Printf("listening: %v", socket.LocalAddr())
+	return s, nil
+}
+
+func listen(config *quiche.Config, h3config *quiche.H3Config, opts *serverOptions) error {
+	s, err := newServer(config, h3config, opts)
+	if err != nil {
+		return err
+	}
+	defer s.socket.Close()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		signal.Stop(sig)
+		log.Print("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), opts.drainTimeout)
+		defer cancel()
+		err := s.shutdown(ctx)
+		if err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}()
+	log.Printf("listening: %v", s.socket.LocalAddr())
 	return s.listen()
 }
 
+// serveMetrics serves server metrics over HTTP in background.
+func serveMetrics(addr string) (*metrics.Metrics, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m := metrics.New("quiche")
+	m.Publish("quiche")
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		err := http.Serve(ln, mux)
+		log.Printf("metrics server: %v", err)
+	}()
+	log.Printf("serving metrics: http://%v/metrics", ln.Addr())
+	return m, nil
+}
+
 type serverConn struct {
+	id []byte
+	// addr is the most recent peer address from which a packet was
+	// successfully processed. Packets are sent to this address.
 	addr net.Addr
-	conn *quiche.Connection
+	conn *quiche.TracedConnection
+	// h3 is created after the handshake in HTTP/3 mode.
+	h3 *quiche.H3Connection
+	// streams are HTTP/0.9 or HTTP/3 request streams.
+	streams map[uint64]*serverStream
+	// echoes are streams in echo or discard mode.
+	echoes map[uint64]*echoStream
+	// tunnels is only available in tunnel mode.
+	tunnels *tunnelMux
+	// qlog is the file of the connection trace if it is not nil.
+	qlog *os.File
+	// metrics is not nil if metrics are collected.
+	metrics *metrics.ConnectionTracer
+	// sampler is not nil if statistics are sampled periodically.
+	sampler *quiche.StatsSampler
+	// established is set when the server sees the handshake completed.
+	established bool
+	// unvalidated is set when the peer address has changed until another
+	// packet processed by quiche arrives from the new address.
+	unvalidated bool
+	// pathBudget is the number of bytes which can still be sent to the
+	// unvalidated address.
+	pathBudget int
+}
+
+// free closes all streams and frees the connection.
+func (c *serverConn) free() {
+	for id, st := range c.streams {
+		st.close()
+		delete(c.streams, id)
+	}
+	if c.tunnels != nil {
+		c.tunnels.closeAll()
+	}
+	if c.h3 != nil {
+		c.h3.Free()
+	}
+	c.conn.Free()
+	if c.qlog != nil {
+		c.qlog.Close()
+	}
+	if c.metrics != nil {
+		c.metrics.Close()
+	}
 }
 
 type server struct {
 	config *quiche.Config
-	socket net.PacketConn
-	conns  map[string]serverConn
+	// h3config is nil if HTTP/3 is not enabled.
+	h3config *quiche.H3Config
+	mode     appMode
+	handler  handler
+	connIDs  quiche.ConnectionIDGenerator
+	socket   net.PacketConn
+	conns    map[string]*serverConn
+	pcap     *quiche.PcapWriter
+	qlogDir  string
+	metrics  *metrics.Metrics
+	stats    statsOptions
+
+	limits   serverLimits
+	rejected rejectCounters
+	// handshaking is the number of connections which are not established.
+	handshaking int
+	// pathStats is used to check whether quiche processed a packet.
+	pathStats quiche.Stats
 
-	noRetry bool
+	// disableMigration must match the transport parameter set in config.
+	// When it is enabled, packets from a new peer address are dropped.
+	disableMigration bool
+	// addrChanged is called when a connection's peer address changes.
+	addrChanged func(id []byte, oldAddr, newAddr net.Addr)
+
+	// tunnelEvents receives events from TCP connections in tunnel mode.
+	tunnelEvents chan tunnelEvent
+	tunnelDial   func(target string) (net.Conn, error)
+	// woken is set by wake to skip waiting for packets.
+	woken int32
+
+	// closing is closed by shutdown to notify the listening loop.
+	closing     chan struct{}
+	shutdownCtx context.Context
+	// draining is only accessed by the listening loop.
+	draining bool
+	// done is closed when the listening loop returns err.
+	done chan struct{}
+	err  error
 }
 
-func (s *server) listen() error {
-	buf := make([]byte, bufferSize)
+func (s *server) listen() (err error) {
+	defer func() {
+		log.Printf("rejected packets: %v", &s.rejected)
+		s.err = err
+		close(s.done)
+	}()
+	b := buffers.Get()
+	defer buffers.Put(b)
+	buf := b.B
 	header := quiche.Header{
 		SCID:  make([]byte, quiche.MaxConnIDLen),
 		DCID:  make([]byte, quiche.MaxConnIDLen),
 		Token: make([]byte, maxTokenLen),
 	}
 	for {
+		if !s.draining && s.isClosing() {
+			s.drain()
+		}
+		if s.draining {
+			if len(s.conns) == 0 {
+				log.Print("all connections closed")
+				return nil
+			}
+			if s.shutdownCtx.Err() != nil {
+				// Expired drain is still a clean shutdown.
+				log.Printf("drain timeout: %d connections force closed", s.freeAll())
+				return nil
+			}
+		}
 		deadline := s.readDeadline()
-		err := s.socket.SetReadDeadline(deadline)
+		err = s.socket.SetReadDeadline(deadline)
 		if err != nil {
 			return err
 		}
+		if !s.draining && s.isClosing() {
+			// shutdown might have woken up the socket before the deadline was set.
+			continue
+		}
 		n, addr, err := s.socket.ReadFrom(buf)
 		if err != nil {
 			if err, ok := err.(net.Error); ok && err.Timeout() {
 				for _, c := range s.conns {
-					c.conn.OnTimeout()
+					// The deadline might have been set by wake or shutdown.
+					if c.conn.Timeout() == 0 {
+						c.conn.OnTimeout()
+					}
 				}
 			} else {
 				return err
 			}
 		} else {
 			log.Printf("got %d bytes", n)
+			capture(s.pcap, addr, s.socket.LocalAddr(), buf[:n])
 			s.recv(buf[:n], addr, &header)
 		}
+		s.respond()
 		s.send(buf[:maxDatagramSize])
+		s.sample()
 		s.close()
 	}
 }
 
+// wake interrupts waiting for packets so that the listening loop can handle
+// events from other goroutines.
+func (s *server) wake() {
+	atomic.StoreInt32(&s.woken, 1)
+	s.socket.SetReadDeadline(time.Now())
+}
+
 func (s *server) readDeadline() time.Time {
-	var minTimeout time.Duration
+	if atomic.SwapInt32(&s.woken, 0) != 0 {
+		return time.Now()
+	}
+	var deadline time.Time
+	minTimeout := time.Duration(-1)
 	for _, c := range s.conns {
+		// Negative timeout means there is no timer.
 		timeout := c.conn.Timeout()
-		if timeout < minTimeout {
+		if timeout >= 0 && (minTimeout < 0 || timeout < minTimeout) {
 			minTimeout = timeout
 		}
 	}
-	if minTimeout > 0 {
-		return time.Now().Add(minTimeout)
+	if minTimeout >= 0 {
+		deadline = time.Now().Add(minTimeout)
+	}
+	for _, c := range s.conns {
+		if c.sampler == nil {
+			continue
+		}
+		if d := c.sampler.Deadline(); !d.IsZero() && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
 	}
-	return time.Time{}
+	if s.draining {
+		if d, ok := s.shutdownCtx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+	}
+	return deadline
+}
+
+// shutdown stops accepting new connections and closes all active connections.
+// It waits until all connections are closed or ctx is done, after which the
+// remaining connections are freed without waiting for them to close.
+// It must be called only once.
+func (s *server) shutdown(ctx context.Context) error {
+	s.shutdownCtx = ctx
+	close(s.closing)
+	// Wake up the listening loop.
+	err := s.socket.SetReadDeadline(time.Now())
+	if err != nil {
+		return err
+	}
+	// The listening loop also returns when ctx is done.
+	<-s.done
+	return s.err
+}
+
+func (s *server) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain closes all connections. The listening loop will keep sending and
+// processing timeouts until they are all closed.
+func (s *server) drain() {
+	s.draining = true
+	for _, c := range s.conns {
+		err := c.conn.CloseWithError(quiche.NoError, "server shutdown")
+		if err != nil && err != quiche.ErrDone {
+			log.Printf("%s failed to close connection: %v", c.addr, err)
+		}
+	}
+}
+
+// freeAll frees all connections and returns the number of them.
+func (s *server) freeAll() int {
+	n := len(s.conns)
+	for k, c := range s.conns {
+		log.Printf("%s connection was not closed in time", c.addr)
+		s.remove(k, c)
+	}
+	return n
 }
 
 func (s *server) recv(buf []byte, addr net.Addr, h *quiche.Header) {
 	err := s.headerInfo(buf, h)
 	if err != nil {
 		log.Printf("%s failed to parse header: %v", addr, err)
+		s.countRejected(rejectInvalidHeader)
 		return
 	}
 	log.Printf("%s packet=%x scid=%x dcid=%x", addr,
 		h.Type, h.SCID, h.DCID)
 	c, ok := s.conns[string(h.DCID)]
 	if !ok {
+		if s.draining {
+			s.reject(addr, rejectShutdown)
+			return
+		}
 		if h.Version != quiche.ProtocolVersion {
 			err = s.negotiate(addr, h, buf)
 			if err != nil {
 				log.Printf("%s failed to write version negotiation: %v", addr, err)
 			} else {
 				log.Printf("%s negotiate version: %x", addr, h.Version)
+				if s.metrics != nil {
+					s.metrics.VersionNegotiationsSent.Inc()
+				}
 			}
 			return
 		}
+		reason, ok := s.admit(addr, false)
+		if !ok {
+			s.reject(addr, reason)
+			return
+		}
 		var scid, odcid []byte
-		if s.noRetry {
-			scid = newConnID()
+		if len(h.Token) > 0 {
+			odcid = s.validateToken(addr, h.Token)
+			if len(odcid) == 0 {
+				s.reject(addr, rejectInvalidToken)
+				return
+			}
+			scid = h.DCID
 		} else {
-			if len(h.Token) == 0 {
-				scid = newConnID()
+			scid, err = s.connIDs.NewConnectionID()
+			if err != nil {
+				log.Printf("%s failed to generate connection id: %v", addr, err)
+				return
+			}
+			if s.limits.needRetry(s.handshaking) {
 				err = s.retry(addr, h, scid, buf)
 				if err != nil {
 					log.Printf("%s failed to write stateless retry: %v", addr, err)
 				} else {
 					log.Printf("%s stateless retry: %x", addr, scid)
+					if s.metrics != nil {
+						s.metrics.RetriesSent.Inc()
+					}
 				}
 				return
 			}
-			odcid = s.validateToken(addr, h.Token)
-			if len(odcid) == 0 {
-				log.Printf("%s invalid address validation token", addr)
-				return
+		}
+		reason, ok = s.admit(addr, true)
+		if !ok {
+			s.reject(addr, reason)
+			return
+		}
+		c = &serverConn{
+			id:      append([]byte(nil), scid...),
+			addr:    addr,
+			streams: make(map[uint64]*serverStream),
+			echoes:  make(map[uint64]*echoStream),
+		}
+		var qlog, stats quiche.Tracer
+		if s.qlogDir != "" {
+			// Without retry, the original destination connection ID is the
+			// one chosen by the client.
+			traceID := odcid
+			if traceID == nil {
+				traceID = h.DCID
 			}
-			scid = h.DCID
+			qlog, c.qlog, err = createQlog(s.qlogDir, traceID, "server")
+			if err != nil {
+				log.Printf("%s failed to create qlog: %v", addr, err)
+				qlog = nil
+			}
+		}
+		if s.metrics != nil {
+			c.metrics = s.metrics.NewConnectionTracer()
+			stats = c.metrics
 		}
-		c = serverConn{
-			addr: addr,
-			conn: quiche.Accept(scid, odcid, s.config),
+		tracer := quiche.MultiTracer(qlog, stats)
+		c.conn = quiche.NewTracedConnection(quiche.Accept(scid, odcid, s.config), scid, tracer)
+		c.sampler = s.stats.newSampler(c.id)
+		if s.tunnelEvents != nil {
+			c.tunnels = newTunnelMux(c.conn, s.tunnelEvents, s.wake)
+			c.tunnels.dial = s.tunnelDial
+			c.tunnels.socks = s.mode == modeSocks
 		}
 		s.conns[string(scid)] = c
+		s.handshaking++
 		log.Printf("%s new connection: %x", addr, scid)
 	}
+	migrating := !equalAddr(c.addr, addr)
+	if migrating && (s.disableMigration || !c.conn.IsEstablished()) {
+		log.Printf("%s dropped packet of connection %x at %s", addr, c.id, c.addr)
+		return
+	}
+	// Packets which quiche drops, e.g. duplicates, must not change the path.
+	var recvBefore uint64
+	checkPath := migrating || c.unvalidated
+	if checkPath {
+		c.conn.Stats(&s.pathStats)
+		recvBefore = s.pathStats.Recv
+	}
 	_, err = c.conn.Recv(buf)
 	if err == quiche.ErrDone {
 		return
 	}
 	if err != nil {
 		log.Printf("%s failed to process packet: %v", addr, err)
-		c.conn.Close(false, 0x1, []byte("fail"))
+		if !migrating {
+			// Do not let packets from another address close the connection.
+			c.conn.CloseWithError(quiche.InternalError, "fail")
+		}
 		return
 	}
+	if checkPath {
+		c.conn.Stats(&s.pathStats)
+		if s.pathStats.Recv == recvBefore {
+			return
+		}
+	}
+	if migrating {
+		// The packet was authenticated so the peer has moved, e.g. NAT rebinding.
+		// It could however be a copy raced by an on-path attacker, so the new
+		// address is only trusted after another packet arrives from it.
+		oldAddr := c.addr
+		c.addr = addr
+		c.unvalidated = true
+		c.pathBudget = 0
+		if s.addrChanged != nil {
+			s.addrChanged(c.id, oldAddr, addr)
+		}
+	} else if c.unvalidated {
+		c.unvalidated = false
+		log.Printf("%s validated address of connection %x", addr, c.id)
+	}
+	if c.unvalidated {
+		c.pathBudget += amplificationFactor * len(buf)
+	}
 	if c.conn.IsEstablished() {
-		s.recvStream(c.conn, buf[:cap(buf)])
+		if !c.established {
+			c.established = true
+			s.handshaking--
+		}
+		if s.h3config != nil {
+			s.pollH3(c)
+		} else if c.tunnels != nil {
+			c.tunnels.poll()
+		} else if s.mode != modeHTTP {
+			s.recvEcho(c)
+		} else {
+			s.recvStream(c)
+		}
 	}
 }
 
+// admit checks whether a new connection from addr is allowed. Rate limit is only
+// applied when the connection is about to be accepted, i.e. after the client
+// address has been validated if retry is required, so that spoofed packets can
+// not consume tokens of other clients.
+func (s *server) admit(addr net.Addr, accept bool) (rejectReason, bool) {
+	reason, ok := s.limits.check(len(s.conns), s.handshaking)
+	if !ok {
+		return reason, false
+	}
+	if accept && s.limits.limiter != nil && !s.limits.limiter.allow(addr, time.Now()) {
+		return rejectRateLimited, false
+	}
+	return 0, true
+}
+
+func (s *server) reject(addr net.Addr, reason rejectReason) {
+	log.Printf("%s rejected new connection: %s", addr, reason)
+	s.countRejected(reason)
+}
+
+func (s *server) countRejected(reason rejectReason) {
+	s.rejected.add(reason)
+	if s.metrics != nil {
+		s.metrics.PacketsRejected.With(reason.String()).Inc()
+	}
+}
+
+func equalAddr(a, b net.Addr) bool {
+	ua, ok := a.(*net.UDPAddr)
+	if !ok {
+		return a.String() == b.String()
+	}
+	ub, ok := b.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	return ua.Port == ub.Port && ua.IP.Equal(ub.IP) && ua.Zone == ub.Zone
+}
+
 func (s *server) headerInfo(buf []byte, h *quiche.Header) error {
 	h.SCID = h.SCID[:cap(h.SCID)]
 	h.DCID = h.DCID[:cap(h.DCID)]
 	h.Token = h.Token[:cap(h.Token)]
-	return quiche.HeaderInfo(buf, quiche.MaxConnIDLen, h)
+	return quiche.HeaderInfo(buf, s.connIDs.ConnectionIDLen(), h)
 }
 
 func (s *server) negotiate(addr net.Addr, h *quiche.Header, buf []byte) error {
@@ -165,7 +597,7 @@ func (s *server) negotiate(addr net.Addr, h *quiche.Header, buf []byte) error {
 	if err != nil {
 		return err
 	}
-	_, err = s.socket.WriteTo(buf[:n], addr)
+	_, err = s.writeTo(buf[:n], addr)
 	return err
 }
 
@@ -175,7 +607,7 @@ func (s *server) retry(addr net.Addr, h *quiche.Header, scid, buf []byte) error
 	if err != nil {
 		return err
 	}
-	_, err = s.socket.WriteTo(buf[:n], addr)
+	_, err = s.writeTo(buf[:n], addr)
 	return err
 }
 
@@ -201,87 +633,303 @@ func (s *server) validateToken(addr net.Addr, token []byte) []byte {
 	return token[len(addrStr):]
 }
 
-func (s *server) recvStream(conn *quiche.Connection, buf []byte) {
+func (s *server) recvStream(c *serverConn) {
+	b := buffers.Get()
+	defer buffers.Put(b)
+	buf := b.B
 	for {
-		id, ok := conn.ReadableNext()
+		id, ok := c.conn.ReadableNext()
 		if !ok {
 			return
 		}
-		n, fin, err := conn.StreamRecv(id, buf)
+		n, fin, err := c.conn.StreamRecv(id, buf)
 		if err != nil {
 			log.Printf("stream %d recv failed: %v", id, err)
+			if quiche.IsFatal(err) {
+				return
+			}
 			continue
 		}
-		log.Printf("stream %d has %d bytes (fin=%v)\n%s", id, n, fin, buf[:n])
-		_, err = conn.StreamSend(id, []byte("Not Found"), true)
-		if err != nil {
-			log.Printf("stream send failed: %v", err)
-			conn.Close(false, 0x1, []byte("fail"))
+		log.Printf("stream %d has %d bytes (fin=%v)", id, n, fin)
+		if id&0x3 != 0 {
+			// Only client-initiated bidirectional streams carry requests.
+			continue
 		}
+		st, ok := c.streams[id]
+		if !ok {
+			st = &serverStream{}
+			c.streams[id] = st
+		}
+		if st.appendRequest(buf[:n], fin) {
+			resp := serveHTTP09(s.handler, st.request)
+			if resp.status != http.StatusOK {
+				resp.body.Close()
+				c.conn.StreamShutdown(id, quiche.ShutdownWrite, uint64(resp.status))
+				st.done = true
+			} else {
+				st.respond(resp.body)
+			}
+		}
+		s.writeStream(c, id, st)
 	}
 }
 
-func (s *server) send(buf []byte) error {
+// respond continues writing responses, echoes and tunnels which were blocked
+// by flow control.
+func (s *server) respond() {
+	if s.tunnelEvents != nil {
+		handleTunnelEvents(s.tunnelEvents, nil)
+	}
 	for _, c := range s.conns {
-		n, err := c.conn.Send(buf)
-		if err == quiche.ErrDone {
-			log.Printf("%s done writing", c.addr)
-			continue
+		if c.tunnels != nil && c.conn.IsEstablished() {
+			c.tunnels.poll()
 		}
-		if err != nil {
-			log.Printf("%s send failed: %v", c.addr, err)
-			c.conn.Close(false, 0x1, []byte("fail"))
-			continue
+		for id, st := range c.echoes {
+			s.writeEcho(c, id, st)
+			if st.blocked && len(st.pending) < maxEchoPending {
+				s.readEcho(c, id, st)
+			}
 		}
-		n, err = s.socket.WriteTo(buf[:n], c.addr)
+		for id, st := range c.streams {
+			if st.body != nil && !st.done {
+				s.writeStream(c, id, st)
+			}
+		}
+	}
+}
+
+func (s *server) writeStream(c *serverConn, id uint64, st *serverStream) {
+	if st.body != nil && !st.done {
+		err := st.write(func(b []byte, fin bool) (int, error) {
+			if c.h3 != nil {
+				return c.h3.SendBody(c.conn.Connection, id, b, fin)
+			}
+			return c.conn.StreamSend(id, b, fin)
+		})
 		if err != nil {
-			return err
+			log.Printf("stream %d send failed: %v", id, err)
+			st.done = true
+			if !quiche.IsFatal(err) {
+				// Only the stream failed so it is reset.
+				c.conn.StreamShutdown(id, quiche.ShutdownWrite, 0)
+			}
+		}
+		if st.done {
+			st.close()
+		}
+	}
+	if st.done {
+		if !st.finRecv && c.h3 == nil {
+			// The request has been served so anything else the client sends
+			// is discarded instead of keeping the stream until its FIN.
+			c.conn.StreamShutdown(id, quiche.ShutdownRead, 0)
+		}
+		delete(c.streams, id)
+	}
+}
+
+// writeTo sends the datagram and captures it if enabled.
+func (s *server) writeTo(b []byte, addr net.Addr) (int, error) {
+	capture(s.pcap, s.socket.LocalAddr(), addr, b)
+	return s.socket.WriteTo(b, addr)
+}
+
+func (s *server) send(buf []byte) error {
+	for _, c := range s.conns {
+		for {
+			if c.unvalidated && c.pathBudget < len(buf) {
+				// The packet could exceed the amplification limit.
+				break
+			}
+			n, err := c.conn.Send(buf)
+			if err == quiche.ErrDone {
+				break
+			}
+			if err != nil {
+				log.Printf("%s send failed: %v", c.addr, err)
+				c.conn.CloseWithError(quiche.InternalError, "fail")
+				break
+			}
+			n, err = s.writeTo(buf[:n], c.addr)
+			if err != nil {
+				return err
+			}
+			if c.unvalidated {
+				c.pathBudget -= n
+			}
+			log.Printf("%s written %d bytes", c.addr, n)
 		}
-		log.Printf("%s written %d bytes", c.addr, n)
 	}
 	return nil
 }
 
+// sample takes due samples of connection statistics.
+func (s *server) sample() {
+	now := time.Now()
+	for _, c := range s.conns {
+		if c.sampler != nil {
+			c.sampler.Poll(c.conn.Connection, now)
+		}
+	}
+}
+
 func (s *server) close() {
-	var stats quiche.Stats
+	var stats quiche.ConnectionStats
 	for k, c := range s.conns {
 		if c.conn.IsClosed() {
-			c.conn.Stats(&stats)
+			if c.sampler != nil {
+				c.sampler.Sample(c.conn.Connection, time.Now())
+				err := s.stats.dump(c.sampler, c.id, "server")
+				if err != nil {
+					log.Printf("%x failed to write stats: %v", c.id, err)
+				}
+			}
+			c.conn.ConnectionStats(&stats, false)
 			log.Println("connection closed:", &stats)
-			delete(s.conns, k)
-			c.conn.Free()
+			s.remove(k, c)
 		}
 	}
 }
 
+// remove frees the connection and removes it from the server.
+func (s *server) remove(key string, c *serverConn) {
+	delete(s.conns, key)
+	if !c.established {
+		s.handshaking--
+	}
+	c.free()
+}
+
 func serverCommand(args []string) error {
 	cmd := flag.NewFlagSet("server", flag.ExitOnError)
 	verbose := cmd.Bool("v", false, "enable debug logging")
+	http3 := cmd.Bool("http3", false, "serve HTTP/3 instead of HTTP/0.9")
+	modeName := cmd.String("mode", "http", "application protocol: http, echo or discard")
 	listenAddr := cmd.String("listen", "127.0.0.1:4433", "listen on the given IP:port")
 	certFile := cmd.String("cert", "cert.crt", "TLS certificate path")
 	keyFile := cmd.String("key", "cert.key", "TLS certificate key path")
+	selfSigned := cmd.Bool("self-signed", false, "generate a self-signed certificate instead of loading cert and key")
+	keyLog := cmd.String("keylog", "", "append TLS secrets to file in NSS key log format (default $SSLKEYLOGFILE)")
+	pcapFile := cmd.String("pcap", "", "write sent and received datagrams to file in pcapng format")
+	qlogDir := cmd.String("qlog", "", "directory to write connection traces to in qlog format")
+	statsInterval := cmd.Duration("stats-interval", 0, "interval to sample connection statistics (0 disables sampling)")
+	statsDir := cmd.String("stats-dir", "", "directory to write sampled statistics to instead of logging them")
+	statsFormat := cmd.String("stats-format", "csv", "format of sampled statistics files: csv or json")
+	metricsAddr := cmd.String("metrics", "", "serve Prometheus metrics at /metrics and expvar at /debug/vars on the given IP:port")
+	certHosts := cmd.String("hosts", defaultCertHosts, "comma-separated host names and IP addresses of the self-signed certificate")
 	rootPath := cmd.String("root", ".", "root directory")
+	listDirs := cmd.Bool("list-dirs", false, "allow listing directories")
+	maxConns := cmd.Int("max-conns", 0, "maximum number of concurrent connections (0 is unlimited)")
+	maxHandshakes := cmd.Int("max-handshakes", 0, "maximum number of in-progress handshakes (0 is unlimited)")
+	rate := cmd.Float64("rate", 0, "new connections per second allowed for each client address prefix (0 is unlimited)")
+	burst := cmd.Int("burst", 10, "burst of new connections allowed for each client address prefix")
+	prefix4 := cmd.Int("rate-prefix4", 32, "IPv4 prefix length to group clients for rate limiting")
+	prefix6 := cmd.Int("rate-prefix6", 64, "IPv6 prefix length to group clients for rate limiting")
+	retry := cmd.String("retry", "always", "when to send stateless retry: always, never or load")
+	retryLoad := cmd.Int("retry-load", 100, "number of in-progress handshakes from which retry is sent in load retry mode")
+	disableMigration := cmd.Bool("disable-migration", false, "drop packets from new client addresses instead of following them (data sent to a new address is limited to 3 times data received until it is validated)")
+	drainTimeout := cmd.Duration("drain-timeout", 10*time.Second, "maximum time to wait for connections to close on shutdown")
+	serverID := cmd.String("server-id", "", "hex-encoded server ID to encode in connection IDs for load balancers")
+	connIDKey := cmd.String("cid-key", "", "hex-encoded AES key to encrypt server ID in connection IDs")
+	connIDConfig := cmd.Uint("cid-config", 0, "config rotation codepoint of connection IDs (0-2)")
 	cmd.Parse(args)
 
+	mode, err := parseAppMode(*modeName)
+	if err != nil {
+		return err
+	}
+	if mode != modeHTTP && *http3 {
+		return fmt.Errorf("-http3 can not be used in %s mode", *modeName)
+	}
 	if *verbose {
 		quiche.EnableDebugLogging()
 	}
-	config, err := newConfig(quiche.ProtocolVersion)
+	config, err := newConfig(quiche.ProtocolVersion, *http3)
 	if err != nil {
 		return err
 	}
 	defer config.Free()
-	if *certFile != "" {
-		err = config.LoadCertChainFromPEMFile(*certFile)
+	if mode != modeHTTP {
+		err = config.SetApplicationProtos(mode.applicationProtos())
+		if err != nil {
+			return err
+		}
+	}
+	config.DisableMigration(*disableMigration)
+	err = setupKeyLog(config, *keyLog)
+	if err != nil {
+		return err
+	}
+	var h3config *quiche.H3Config
+	if *http3 {
+		h3config = newH3Config()
+		defer h3config.Free()
+	}
+	if *selfSigned {
+		err = loadSelfSigned(config, *certHosts)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = loadCertFiles(config, *certFile, *keyFile)
+		if err != nil {
+			return err
+		}
+	}
+	files, err := newFileServer(*rootPath, *listDirs)
+	if err != nil {
+		return err
+	}
+	opts := serverOptions{
+		listenAddr: *listenAddr,
+		mode:       mode,
+		handler:    files,
+		limits: serverLimits{
+			maxConns:      *maxConns,
+			maxHandshakes: *maxHandshakes,
+			retryLoad:     *retryLoad,
+		},
+		disableMigration: *disableMigration,
+		drainTimeout:     *drainTimeout,
+		qlogDir:          *qlogDir,
+		stats: statsOptions{
+			interval: *statsInterval,
+			dir:      *statsDir,
+			format:   *statsFormat,
+		},
+	}
+	err = parseStatsFormat(*statsFormat)
+	if err != nil {
+		return err
+	}
+	if *metricsAddr != "" {
+		opts.metrics, err = serveMetrics(*metricsAddr)
+		if err != nil {
+			return err
+		}
+	}
+	if *pcapFile != "" {
+		var f *os.File
+		opts.pcap, f, err = createPcap(*pcapFile)
 		if err != nil {
 			return err
 		}
+		defer f.Close()
+	}
+	opts.connIDs, err = newConnIDGenerator(*connIDConfig, *serverID, *connIDKey)
+	if err != nil {
+		return err
+	}
+	opts.limits.retry, err = parseRetryMode(*retry)
+	if err != nil {
+		return err
 	}
-	if *keyFile != "" {
-		err = config.LoadPrivKeyFromPEMFile(*keyFile)
+	if *rate > 0 {
+		err = checkPrefixLen(*prefix4, *prefix6)
 		if err != nil {
 			return err
 		}
+		opts.limits.limiter = newRateLimiter(*rate, *burst, *prefix4, *prefix6)
 	}
-	return listen(config, *listenAddr, *rootPath)
+	return listen(config, h3config, &opts)
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const socksHandshakeTimeout = 10 * time.Second
+
+// SOCKS5 constants in RFC 1928.
+const (
+	socksVersion        = 5
+	socksMethodNoAuth   = 0
+	socksMethodNone     = 0xff
+	socksCmdConnect     = 1
+	socksAddrIPv4       = 1
+	socksAddrDomainName = 3
+	socksAddrIPv6       = 4
+
+	socksSucceeded           = 0
+	socksGeneralFailure      = 1
+	socksHostUnreachable     = 4
+	socksConnectionRefused   = 5
+	socksCmdNotSupported     = 7
+	socksAddrTypeUnsupported = 8
+)
+
+// socksHandshake negotiates no authentication and reads a CONNECT request.
+// It returns the requested address as "host:port". The reply is sent after
+// the target has been connected, or before returning an error if the request
+// can not be forwarded.
+func socksHandshake(conn net.Conn) (string, error) {
+	var b [256]byte
+	_, err := io.ReadFull(conn, b[:2])
+	if err != nil {
+		return "", err
+	}
+	if b[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", b[0])
+	}
+	methods := b[:b[1]]
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return "", err
+	}
+	method := byte(socksMethodNone)
+	for _, m := range methods {
+		if m == socksMethodNoAuth {
+			method = m
+			break
+		}
+	}
+	_, err = conn.Write([]byte{socksVersion, method})
+	if err != nil {
+		return "", err
+	}
+	if method == socksMethodNone {
+		return "", errors.New("no acceptable authentication methods")
+	}
+	// VER CMD RSV ATYP
+	_, err = io.ReadFull(conn, b[:4])
+	if err != nil {
+		return "", err
+	}
+	if b[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", b[0])
+	}
+	if b[1] != socksCmdConnect {
+		conn.Write(appendSocksReply(nil, socksCmdNotSupported))
+		return "", fmt.Errorf("unsupported command %d", b[1])
+	}
+	var host string
+	switch b[3] {
+	case socksAddrIPv4:
+		_, err = io.ReadFull(conn, b[:net.IPv4len])
+		host = net.IP(b[:net.IPv4len]).String()
+	case socksAddrIPv6:
+		_, err = io.ReadFull(conn, b[:net.IPv6len])
+		host = net.IP(b[:net.IPv6len]).String()
+	case socksAddrDomainName:
+		_, err = io.ReadFull(conn, b[:1])
+		if err == nil {
+			n := int(b[0])
+			_, err = io.ReadFull(conn, b[:n])
+			host = string(b[:n])
+		}
+	default:
+		conn.Write(appendSocksReply(nil, socksAddrTypeUnsupported))
+		return "", fmt.Errorf("unsupported address type %d", b[3])
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = io.ReadFull(conn, b[:2])
+	if err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(b[:2])
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if len(target) > maxTunnelTarget {
+		conn.Write(appendSocksReply(nil, socksGeneralFailure))
+		return "", fmt.Errorf("target address too long: %d bytes", len(target))
+	}
+	return target, nil
+}
+
+// appendSocksReply appends a reply with an unspecified bound address to b.
+func appendSocksReply(b []byte, rep byte) []byte {
+	return append(b, socksVersion, rep, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0)
+}
+
+// socksReplyCode maps the connect status sent by the tunnel server to the SOCKS reply code.
+func socksReplyCode(status uint64) byte {
+	switch status {
+	case 0:
+		return socksSucceeded
+	case tunnelErrRefused:
+		return socksConnectionRefused
+	case tunnelErrUnreachable:
+		return socksHostUnreachable
+	default:
+		return socksGeneralFailure
+	}
+}
+
+// connectErrorCode returns the stream error code of a failure to connect the target.
+func connectErrorCode(err error) uint64 {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED:
+			return tunnelErrRefused
+		case syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+			return tunnelErrUnreachable
+		}
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return tunnelErrUnreachable
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return tunnelErrUnreachable
+	}
+	return tunnelErrConnect
+}
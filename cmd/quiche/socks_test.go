@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSocksHandshake(t *testing.T) {
+	greeting := []byte{socksVersion, 1, socksMethodNoAuth}
+	accepted := []byte{socksVersion, socksMethodNoAuth}
+	connect := func(atyp byte, addr ...byte) []byte {
+		b := append([]byte{}, greeting...)
+		b = append(b, socksVersion, socksCmdConnect, 0, atyp)
+		b = append(b, addr...)
+		return append(b, 0x01, 0xbb)
+	}
+	domain := func(name string) []byte {
+		return append([]byte{byte(len(name))}, name...)
+	}
+	reply := func(rep byte) []byte {
+		return append(append([]byte{}, accepted...), appendSocksReply(nil, rep)...)
+	}
+	tests := []struct {
+		req    []byte
+		target string
+		reply  []byte
+	}{
+		{connect(socksAddrIPv4, 192, 0, 2, 1), "192.0.2.1:443", accepted},
+		{connect(socksAddrIPv6, net.ParseIP("2001:db8::1")...), "[2001:db8::1]:443", accepted},
+		{connect(socksAddrDomainName, domain("example.com")...), "example.com:443", accepted},
+		// The target does not fit in the tunnel stream header.
+		{connect(socksAddrDomainName, domain(strings.Repeat("a", 255))...), "", reply(socksGeneralFailure)},
+		{[]byte{4, 1, socksMethodNoAuth}, "", nil},
+		{[]byte{socksVersion, 1, 2}, "", []byte{socksVersion, socksMethodNone}},
+		{append(append([]byte{}, greeting...), socksVersion, 2, 0, socksAddrIPv4), "", reply(socksCmdNotSupported)},
+		{append(append([]byte{}, greeting...), socksVersion, socksCmdConnect, 0, 2), "", reply(socksAddrTypeUnsupported)},
+	}
+	for i, tt := range tests {
+		target, rep, err := pipeSocksHandshake(tt.req)
+		if target != tt.target || (err == nil) != (tt.target != "") {
+			t.Fatalf("%d: unexpected target: want %q, actual %q (%v)", i, tt.target, target, err)
+		}
+		if !bytes.Equal(rep, tt.reply) {
+			t.Fatalf("%d: unexpected reply: want %x, actual %x", i, tt.reply, rep)
+		}
+	}
+}
+
+// pipeSocksHandshake runs socksHandshake with req sent by the client and
+// returns the target and the reply received by the client.
+func pipeSocksHandshake(req []byte) (string, []byte, error) {
+	client, server := net.Pipe()
+	defer client.Close()
+	type result struct {
+		target string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		target, err := socksHandshake(server)
+		server.Close()
+		done <- result{target, err}
+	}()
+	// The server might return before reading the whole request.
+	go client.Write(req)
+	rep, _ := ioutil.ReadAll(client)
+	r := <-done
+	return r.target, rep, r.err
+}
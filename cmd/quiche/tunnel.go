@@ -0,0 +1,785 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goburrow/quiche"
+)
+
+const (
+	tunnelEventsLen   = 64
+	tunnelDialTimeout = 10 * time.Second
+	// maxTunnelTarget is the maximum length of the target address in the
+	// SOCKS stream header, which carries the length in one byte.
+	maxTunnelTarget = 255
+)
+
+// Application error codes used to shut down tunnel streams. In SOCKS mode,
+// they are also the connect status sent by the server.
+const (
+	// tunnelErrAborted means the TCP connection failed.
+	tunnelErrAborted uint64 = 1
+	// tunnelErrConnect means the target could not be connected.
+	tunnelErrConnect uint64 = 2
+	// tunnelErrRefused means the target refused the connection.
+	tunnelErrRefused uint64 = 3
+	// tunnelErrUnreachable means the target host or network is unreachable.
+	tunnelErrUnreachable uint64 = 4
+	// tunnelErrInvalidTarget means the stream header is malformed.
+	tunnelErrInvalidTarget uint64 = 5
+)
+
+type tunnelEventType int
+
+const (
+	tunnelAccepted tunnelEventType = iota // A TCP connection was accepted.
+	tunnelDialed                          // A TCP connection was dialed for a stream.
+	tunnelRead                            // Data was read from TCP.
+	tunnelWritten                         // Data was written to TCP.
+)
+
+// tunnelEvent is sent from TCP goroutines to the loop owning the QUIC connection.
+type tunnelEvent struct {
+	typ  tunnelEventType
+	t    *tunnel
+	conn net.Conn
+	// target is the address requested by the accepted SOCKS connection.
+	target string
+	data   []byte
+	// err is io.EOF when the TCP connection is half-closed by the peer.
+	err error
+}
+
+// handleTunnelEvents handles queued events without blocking. Accepted
+// connections are passed to accept.
+func handleTunnelEvents(events chan tunnelEvent, accept func(conn net.Conn, target string)) {
+	for {
+		select {
+		case ev := <-events:
+			if ev.typ == tunnelAccepted {
+				accept(ev.conn, ev.target)
+			} else {
+				ev.t.handle(&ev)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// tunnelMux maps bidirectional streams of a QUIC connection to TCP connections.
+// Except notify, it must only be used by the loop owning the connection.
+type tunnelMux struct {
+	conn    *quiche.TracedConnection
+	events  chan tunnelEvent
+	wake    func()
+	tunnels map[uint64]*tunnel
+	// dial connects streams opened by the peer to target, which is empty
+	// unless in SOCKS mode. The peer is not allowed to open streams when it is nil.
+	dial func(target string) (net.Conn, error)
+	// socks is whether streams begin with a header carrying the target
+	// address, which the server answers with a connect status.
+	socks bool
+	// nextID is the ID of the next stream to be opened locally.
+	nextID uint64
+	// nextPeerID is the minimum ID of new streams opened by the peer.
+	nextPeerID uint64
+}
+
+func newTunnelMux(conn *quiche.TracedConnection, events chan tunnelEvent, wake func()) *tunnelMux {
+	return &tunnelMux{
+		conn:    conn,
+		events:  events,
+		wake:    wake,
+		tunnels: make(map[uint64]*tunnel),
+		nextID:  httpRequestStreamID,
+	}
+}
+
+// notify queues the event of tunnel t and wakes up the loop. It returns false
+// if the tunnel has been closed.
+func (m *tunnelMux) notify(ev tunnelEvent) bool {
+	select {
+	case m.events <- ev:
+		m.wake()
+		return true
+	case <-ev.t.closed:
+		return false
+	}
+}
+
+func (m *tunnelMux) newTunnel(id uint64) *tunnel {
+	t := &tunnel{
+		mux:     m,
+		id:      id,
+		readAck: make(chan struct{}, 1),
+		out:     make(chan []byte, 1),
+		closed:  make(chan struct{}),
+	}
+	m.tunnels[id] = t
+	return t
+}
+
+// open maps the TCP connection to a new stream. In SOCKS mode, the stream
+// begins with the target address, whose length has been checked by socksHandshake.
+func (m *tunnelMux) open(conn net.Conn, target string) {
+	t := m.newTunnel(m.nextID)
+	m.nextID += 4
+	log.Printf("tunnel %d opened from %s", t.id, conn.RemoteAddr())
+	if m.socks {
+		t.prefix = append([]byte{byte(len(target))}, target...)
+		t.awaitStatus = true
+	}
+	t.start(conn)
+	t.send()
+}
+
+// accept maps the new stream opened by the peer to a TCP connection. In SOCKS
+// mode, the target is dialed after its address is received.
+func (m *tunnelMux) accept(id uint64) {
+	t := m.newTunnel(id)
+	m.nextPeerID = id + 4
+	log.Printf("tunnel %d accepted", id)
+	if m.socks {
+		t.recv()
+	} else {
+		t.dial("")
+	}
+}
+
+// poll reads readable streams and sends data blocked by flow control.
+func (m *tunnelMux) poll() {
+	for {
+		id, ok := m.conn.ReadableNext()
+		if !ok {
+			break
+		}
+		t, ok := m.tunnels[id]
+		if ok {
+			t.recv()
+			continue
+		}
+		if m.dial != nil && id&0x3 == 0 && id >= m.nextPeerID {
+			m.accept(id)
+			continue
+		}
+		m.discard(id)
+	}
+	for _, t := range m.tunnels {
+		t.send()
+		t.recv()
+	}
+}
+
+// discard reads and ignores data of a stream which is not a tunnel.
+func (m *tunnelMux) discard(id uint64) {
+	b := buffers.Get()
+	defer buffers.Put(b)
+	for {
+		_, _, err := m.conn.StreamRecv(id, b.B)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// closeAll closes all TCP connections.
+func (m *tunnelMux) closeAll() {
+	for _, t := range m.tunnels {
+		t.close()
+	}
+}
+
+// tunnel is a TCP connection mapped to a bidirectional stream. The TCP
+// connection is read and written in its own goroutines, which hand data over
+// to the loop owning the QUIC connection.
+type tunnel struct {
+	mux *tunnelMux
+	id  uint64
+	// tcp is nil until the target is connected.
+	tcp net.Conn
+
+	// prefix is sent on the stream before data read from TCP.
+	prefix []byte
+	// target is the partially received SOCKS header.
+	target  []byte
+	dialing bool
+	// awaitStatus is whether the SOCKS client is waiting for the connect status.
+	awaitStatus bool
+	// failed is whether the SOCKS failure reply is being written.
+	failed bool
+
+	// in is data read from TCP which has not been sent on the stream.
+	in    []byte
+	inErr error
+	// reading is whether the reader is waiting for in to be sent.
+	reading bool
+	readAck chan struct{}
+	finSent bool
+
+	// out passes stream data to the writer. Empty data requests half-close.
+	out     chan []byte
+	outBuf  *quiche.Buffer
+	writing bool
+	finRecv bool
+	outDone bool
+
+	sent     int64
+	received int64
+	closed   chan struct{}
+	done     bool
+}
+
+func (t *tunnel) start(conn net.Conn) {
+	t.tcp = conn
+	go t.readTCP()
+	go t.writeTCP()
+}
+
+// dial connects to the target in a new goroutine.
+func (t *tunnel) dial(target string) {
+	t.dialing = true
+	go func() {
+		conn, err := t.mux.dial(target)
+		if !t.mux.notify(tunnelEvent{typ: tunnelDialed, t: t, conn: conn, err: err}) && conn != nil {
+			conn.Close()
+		}
+	}()
+}
+
+func (t *tunnel) readTCP() {
+	b := buffers.Get()
+	defer buffers.Put(b)
+	for {
+		n, err := t.tcp.Read(b.B)
+		if n == 0 && err == nil {
+			continue
+		}
+		if !t.mux.notify(tunnelEvent{typ: tunnelRead, t: t, data: b.B[:n], err: err}) {
+			return
+		}
+		// Wait until the data has been sent as the buffer is reused.
+		select {
+		case <-t.readAck:
+		case <-t.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (t *tunnel) writeTCP() {
+	for {
+		var b []byte
+		select {
+		case b = <-t.out:
+		case <-t.closed:
+			return
+		}
+		var err error
+		if len(b) == 0 {
+			err = closeWrite(t.tcp)
+		} else {
+			_, err = t.tcp.Write(b)
+		}
+		if !t.mux.notify(tunnelEvent{typ: tunnelWritten, t: t, err: err}) || err != nil || len(b) == 0 {
+			return
+		}
+	}
+}
+
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+func (t *tunnel) handle(ev *tunnelEvent) {
+	if t.done {
+		if ev.conn != nil {
+			ev.conn.Close()
+		}
+		return
+	}
+	switch ev.typ {
+	case tunnelDialed:
+		if ev.err != nil {
+			log.Printf("tunnel %d connect failed: %v", t.id, ev.err)
+			t.fail(connectErrorCode(ev.err))
+			return
+		}
+		log.Printf("tunnel %d connected to %s", t.id, ev.conn.RemoteAddr())
+		if t.mux.socks {
+			t.prefix = []byte{0}
+		}
+		t.start(ev.conn)
+		t.send()
+		t.recv()
+	case tunnelRead:
+		t.in = ev.data
+		t.inErr = ev.err
+		t.reading = true
+		t.send()
+	case tunnelWritten:
+		t.writing = false
+		if t.outBuf != nil {
+			buffers.Put(t.outBuf)
+			t.outBuf = nil
+		}
+		if ev.err != nil {
+			log.Printf("tunnel %d write failed: %v", t.id, ev.err)
+			t.abort(tunnelErrAborted)
+			return
+		}
+		if t.failed {
+			t.abort(tunnelErrConnect)
+			return
+		}
+		t.recv()
+	}
+}
+
+// send sends data read from TCP, or FIN when TCP has been half-closed.
+func (t *tunnel) send() {
+	if t.done {
+		return
+	}
+	if len(t.prefix) > 0 {
+		n, err := t.mux.conn.StreamSend(t.id, t.prefix, false)
+		if err == quiche.ErrDone {
+			return
+		}
+		if err != nil {
+			log.Printf("tunnel %d send failed: %v", t.id, err)
+			t.abort(tunnelErrAborted)
+			return
+		}
+		t.prefix = t.prefix[n:]
+		if len(t.prefix) > 0 {
+			return
+		}
+	}
+	if !t.reading {
+		return
+	}
+	if t.inErr != nil && t.inErr != io.EOF {
+		log.Printf("tunnel %d read failed: %v", t.id, t.inErr)
+		t.abort(tunnelErrAborted)
+		return
+	}
+	fin := t.inErr == io.EOF
+	n, err := t.mux.conn.StreamSend(t.id, t.in, fin)
+	if err == quiche.ErrDone {
+		return
+	}
+	if err != nil {
+		log.Printf("tunnel %d send failed: %v", t.id, err)
+		t.abort(tunnelErrAborted)
+		return
+	}
+	t.sent += int64(n)
+	t.in = t.in[n:]
+	if len(t.in) > 0 {
+		// Blocked by flow control.
+		return
+	}
+	t.reading = false
+	t.readAck <- struct{}{}
+	if fin {
+		t.finSent = true
+		t.closeIfDone()
+	}
+}
+
+// recv passes stream data to the writer when it is idle.
+func (t *tunnel) recv() {
+	if t.tcp == nil && !t.dialing && !t.done {
+		t.recvTarget()
+		return
+	}
+	if t.awaitStatus && !t.writing && !t.done {
+		t.recvStatus()
+	}
+	for t.tcp != nil && !t.writing && !t.outDone && !t.done {
+		if t.finRecv {
+			// All data has been written.
+			t.writing = true
+			t.outDone = true
+			t.out <- nil
+			return
+		}
+		b := buffers.Get()
+		n, fin, err := t.mux.conn.StreamRecv(t.id, b.B)
+		if err == quiche.ErrDone {
+			buffers.Put(b)
+			return
+		}
+		if err != nil {
+			buffers.Put(b)
+			log.Printf("tunnel %d recv failed: %v", t.id, err)
+			t.abort(tunnelErrAborted)
+			return
+		}
+		t.received += int64(n)
+		t.finRecv = fin
+		if n == 0 {
+			buffers.Put(b)
+			continue
+		}
+		t.outBuf = b
+		t.writing = true
+		t.out <- b.B[:n]
+	}
+	t.closeIfDone()
+}
+
+// recvTarget reads the SOCKS header and dials the target address.
+func (t *tunnel) recvTarget() {
+	b := buffers.Get()
+	defer buffers.Put(b)
+	for {
+		// The header is the address length followed by the address.
+		need := 1
+		if len(t.target) > 0 {
+			need = 1 + int(t.target[0]) - len(t.target)
+		}
+		if need == 0 {
+			break
+		}
+		n, fin, err := t.mux.conn.StreamRecv(t.id, b.B[:need])
+		if err == quiche.ErrDone {
+			return
+		}
+		if err != nil {
+			log.Printf("tunnel %d recv failed: %v", t.id, err)
+			t.abort(tunnelErrAborted)
+			return
+		}
+		t.target = append(t.target, b.B[:n]...)
+		t.finRecv = fin
+		if fin && n < need {
+			t.fail(tunnelErrInvalidTarget)
+			return
+		}
+	}
+	target := string(t.target[1:])
+	t.target = nil
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		log.Printf("tunnel %d invalid target: %q", t.id, target)
+		t.fail(tunnelErrInvalidTarget)
+		return
+	}
+	log.Printf("tunnel %d connecting to %s", t.id, target)
+	t.dial(target)
+}
+
+// recvStatus reads the connect status and writes the SOCKS reply.
+func (t *tunnel) recvStatus() {
+	b := buffers.Get()
+	n, fin, err := t.mux.conn.StreamRecv(t.id, b.B[:1])
+	if err == quiche.ErrDone {
+		buffers.Put(b)
+		return
+	}
+	status := tunnelErrAborted
+	if err == nil && n == 1 {
+		status = uint64(b.B[0])
+	}
+	t.awaitStatus = false
+	t.finRecv = fin
+	if status != 0 {
+		log.Printf("tunnel %d connect failed: status %d", t.id, status)
+		t.failed = true
+	}
+	t.outBuf = b
+	t.writing = true
+	t.out <- appendSocksReply(b.B[:0], socksReplyCode(status))
+}
+
+// fail sends the connect status in SOCKS mode before shutting down the stream.
+func (t *tunnel) fail(code uint64) {
+	if t.mux.socks {
+		t.mux.conn.StreamSend(t.id, []byte{byte(code)}, true)
+		t.mux.conn.StreamShutdown(t.id, quiche.ShutdownRead, code)
+		t.close()
+		return
+	}
+	t.abort(code)
+}
+
+func (t *tunnel) closeIfDone() {
+	if t.finSent && t.outDone && !t.writing {
+		t.close()
+	}
+}
+
+// abort shuts down both directions of the stream with the error code.
+func (t *tunnel) abort(code uint64) {
+	t.mux.conn.StreamShutdown(t.id, quiche.ShutdownRead, code)
+	t.mux.conn.StreamShutdown(t.id, quiche.ShutdownWrite, code)
+	t.close()
+}
+
+func (t *tunnel) close() {
+	if t.done {
+		return
+	}
+	t.done = true
+	close(t.closed)
+	if t.tcp != nil {
+		t.tcp.Close()
+	}
+	// The writer might still be using outBuf.
+	t.outBuf = nil
+	delete(t.mux.tunnels, t.id)
+	log.Printf("tunnel %d closed: %d bytes sent, %d bytes received", t.id, t.sent, t.received)
+}
+
+// tunnelClient accepts TCP connections and maps them to streams of the client
+// connection. In SOCKS mode, the target of each connection is read by the
+// SOCKS handshake.
+type tunnelClient struct {
+	events chan tunnelEvent
+	mux    *tunnelMux
+	socks  bool
+	// done is closed when the QUIC connection has been closed.
+	done chan struct{}
+}
+
+func newTunnelClient(c *client, socks bool) *tunnelClient {
+	events := make(chan tunnelEvent, tunnelEventsLen)
+	tc := &tunnelClient{
+		events: events,
+		mux:    newTunnelMux(c.conn, events, c.wake),
+		socks:  socks,
+		done:   make(chan struct{}),
+	}
+	tc.mux.socks = socks
+	return tc
+}
+
+// acceptLoop passes accepted connections to the client until the listener is closed.
+func (tc *tunnelClient) acceptLoop(l net.Listener, wake func()) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		if tc.socks {
+			go tc.acceptSocks(conn, wake)
+		} else if !tc.accepted(conn, "", wake) {
+			return
+		}
+	}
+}
+
+func (tc *tunnelClient) acceptSocks(conn net.Conn, wake func()) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	target, err := socksHandshake(conn)
+	if err != nil {
+		log.Printf("%s SOCKS handshake failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	tc.accepted(conn, target, wake)
+}
+
+// accepted passes the connection to the client. It returns false if the
+// QUIC connection has been closed.
+func (tc *tunnelClient) accepted(conn net.Conn, target string, wake func()) bool {
+	select {
+	case tc.events <- tunnelEvent{typ: tunnelAccepted, conn: conn, target: target}:
+		wake()
+		return true
+	case <-tc.done:
+		conn.Close()
+		return false
+	}
+}
+
+func (tc *tunnelClient) start(conn *quiche.TracedConnection) {
+	log.Print("tunnel connection established")
+}
+
+func (tc *tunnelClient) poll(conn *quiche.TracedConnection) {
+	handleTunnelEvents(tc.events, tc.mux.open)
+	tc.mux.poll()
+}
+
+func (tc *tunnelClient) closed() error {
+	close(tc.done)
+	tc.mux.closeAll()
+	return errors.New("tunnel connection closed")
+}
+
+// parseTunnelAddr returns the address in s of form "network:host:port".
+func parseTunnelAddr(s, network string) (string, error) {
+	if !strings.HasPrefix(s, network+":") {
+		return "", fmt.Errorf("address must start with %s: %q", network, s)
+	}
+	return s[len(network)+1:], nil
+}
+
+func tunnelCommand(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "client":
+			return tunnelClientCommand(args[1:], false)
+		case "socks":
+			return tunnelClientCommand(args[1:], true)
+		case "server":
+			return tunnelServerCommand(args[1:])
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Usage: quiche tunnel client -listen tcp:IP:PORT -remote quic:HOST:PORT [options]")
+	fmt.Fprintln(os.Stderr, "       quiche tunnel socks -listen tcp:IP:PORT -remote quic:HOST:PORT [options]")
+	fmt.Fprintln(os.Stderr, "       quiche tunnel server -listen quic:IP:PORT (-target tcp:HOST:PORT | -socks) [options]")
+	return errors.New("invalid tunnel command")
+}
+
+// tunnelClientCommand runs a tunnel client, or a SOCKS5 server which forwards
+// CONNECT requests over the tunnel.
+func tunnelClientCommand(args []string, socks bool) error {
+	name, mode := "tunnel client", modeTunnel
+	if socks {
+		name, mode = "tunnel socks", modeSocks
+	}
+	cmd := flag.NewFlagSet(name, flag.ExitOnError)
+	verbose := cmd.Bool("v", false, "enable debug logging")
+	listenAddr := cmd.String("listen", "", "accept TCP connections on tcp:IP:PORT")
+	remoteAddr := cmd.String("remote", "", "tunnel server address quic:HOST:PORT")
+	serverName := cmd.String("server-name", "", "server name to verify (default host of remote address)")
+	noVerify := cmd.Bool("no-verify", false, "don't verify server's certificate")
+	idleTimeout := cmd.Duration("idle-timeout", 10*time.Minute, "close the QUIC connection after being idle for this duration")
+	cmd.Parse(args)
+
+	laddr, err := parseTunnelAddr(*listenAddr, "tcp")
+	if err != nil {
+		return err
+	}
+	remote, err := parseTunnelAddr(*remoteAddr, "quic")
+	if err != nil {
+		return err
+	}
+	if *serverName == "" {
+		*serverName, _, err = net.SplitHostPort(remote)
+		if err != nil {
+			return err
+		}
+	}
+	if *verbose {
+		quiche.EnableDebugLogging()
+	}
+	config, err := newTunnelConfig(mode, *idleTimeout)
+	if err != nil {
+		return err
+	}
+	defer config.Free()
+	if *noVerify {
+		config.VerifyPeer(false)
+	}
+	l, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	c, err := dial(config, nil, remote, *serverName, nil)
+	if err != nil {
+		return err
+	}
+	defer c.free()
+	tc := newTunnelClient(c, socks)
+	c.app = tc
+	log.Printf("listening: %v", l.Addr())
+	go tc.acceptLoop(l, c.wake)
+	return c.connect()
+}
+
+func tunnelServerCommand(args []string) error {
+	cmd := flag.NewFlagSet("tunnel server", flag.ExitOnError)
+	verbose := cmd.Bool("v", false, "enable debug logging")
+	listenAddr := cmd.String("listen", "quic:127.0.0.1:4433", "listen on quic:IP:PORT")
+	targetAddr := cmd.String("target", "", "forward streams to tcp:HOST:PORT")
+	socks := cmd.Bool("socks", false, "connect streams to addresses requested by SOCKS clients instead of target; any client can reach any address reachable by the server")
+	certFile := cmd.String("cert", "cert.crt", "TLS certificate path")
+	keyFile := cmd.String("key", "cert.key", "TLS certificate key path")
+	idleTimeout := cmd.Duration("idle-timeout", 10*time.Minute, "close QUIC connections after being idle for this duration")
+	drainTimeout := cmd.Duration("drain-timeout", 10*time.Second, "maximum time to wait for connections to close on shutdown")
+	cmd.Parse(args)
+
+	laddr, err := parseTunnelAddr(*listenAddr, "quic")
+	if err != nil {
+		return err
+	}
+	mode := modeTunnel
+	var target string
+	if *socks {
+		if *targetAddr != "" {
+			return errors.New("-target can not be used with -socks")
+		}
+		mode = modeSocks
+	} else {
+		target, err = parseTunnelAddr(*targetAddr, "tcp")
+		if err != nil {
+			return err
+		}
+	}
+	if *verbose {
+		quiche.EnableDebugLogging()
+	}
+	config, err := newTunnelConfig(mode, *idleTimeout)
+	if err != nil {
+		return err
+	}
+	defer config.Free()
+	err = config.LoadCertChainFromPEMFile(*certFile)
+	if err != nil {
+		return err
+	}
+	err = config.LoadPrivKeyFromPEMFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	connIDs, err := quiche.NewRandomConnectionIDGenerator(quiche.MaxConnIDLen)
+	if err != nil {
+		return err
+	}
+	opts := serverOptions{
+		listenAddr:       laddr,
+		mode:             mode,
+		tunnelTarget:     target,
+		connIDs:          connIDs,
+		disableMigration: true,
+		drainTimeout:     *drainTimeout,
+	}
+	return listen(config, nil, &opts)
+}
+
+func newTunnelConfig(mode appMode, idleTimeout time.Duration) (*quiche.Config, error) {
+	config, err := newConfig(quiche.ProtocolVersion, false)
+	if err != nil {
+		return nil, err
+	}
+	err = config.SetApplicationProtos(mode.applicationProtos())
+	if err != nil {
+		config.Free()
+		return nil, err
+	}
+	config.SetIdleTimeout(idleTimeout)
+	return config, nil
+}
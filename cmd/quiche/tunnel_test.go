@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/goburrow/quiche"
+)
+
+func TestTunnelEcho(t *testing.T) {
+	// TCP echo server which half-closes after the client does.
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				closeWrite(conn)
+			}()
+		}
+	}()
+
+	serverConfig, err := newTunnelConfig(modeTunnel, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConfig.Free()
+	err = loadSelfSigned(serverConfig, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connIDs, err := quiche.NewRandomConnectionIDGenerator(quiche.MaxConnIDLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newServer(serverConfig, nil, &serverOptions{
+		listenAddr:       "127.0.0.1:0",
+		mode:             modeTunnel,
+		tunnelTarget:     echo.Addr().String(),
+		connIDs:          connIDs,
+		disableMigration: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.socket.Close()
+	go s.listen()
+
+	clientConfig, err := newTunnelConfig(modeTunnel, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConfig.Free()
+	clientConfig.VerifyPeer(false)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := dial(clientConfig, nil, s.socket.LocalAddr().String(), "127.0.0.1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := newTunnelClient(c, false)
+	c.app = tc
+	go tc.acceptLoop(l, c.wake)
+	clientDone := make(chan error, 1)
+	go func() {
+		clientDone <- c.connect()
+	}()
+	defer func() {
+		// The client returns when the server closes the connection on shutdown.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.shutdown(ctx)
+		select {
+		case <-clientDone:
+			c.free()
+		case <-time.After(5 * time.Second):
+			t.Error("client was not closed")
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	data := []byte("hello tunnel")
+	_, err = conn.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Data is echoed before the half-close is forwarded.
+	b := make([]byte, len(data))
+	_, err = io.ReadFull(conn, b)
+	if err != nil || string(b) != string(data) {
+		t.Fatalf("unexpected echo: %q %v", b, err)
+	}
+	err = closeWrite(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The echo server half-closes in return.
+	rest, err := ioutil.ReadAll(conn)
+	if err != nil || len(rest) > 0 {
+		t.Fatalf("unexpected data after half-close: %q %v", rest, err)
+	}
+}
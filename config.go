@@ -29,7 +29,7 @@ func (c *Config) LoadCertChainFromPEMFile(path string) error {
 	err := C.quiche_config_load_cert_chain_from_pem_file((*C.quiche_config)(c), cs)
 	C.free(unsafe.Pointer(cs))
 	if err != 0 {
-		return Error(err)
+		return toError(int(err))
 	}
 	return nil
 }
@@ -40,7 +40,7 @@ func (c *Config) LoadPrivKeyFromPEMFile(path string) error {
 	err := C.quiche_config_load_priv_key_from_pem_file((*C.quiche_config)(c), cp)
 	C.free(unsafe.Pointer(cp))
 	if err != 0 {
-		return Error(err)
+		return toError(int(err))
 	}
 	return nil
 }
@@ -55,7 +55,8 @@ func (c *Config) Grease(v bool) {
 	C.quiche_config_grease((*C.quiche_config)(c), C.bool(v))
 }
 
-// LogKeys enables logging of secrets.
+// LogKeys enables logging of TLS secrets in NSS key log format to the file
+// named by the SSLKEYLOGFILE environment variable.
 func (c *Config) LogKeys() {
 	C.quiche_config_log_keys((*C.quiche_config)(c))
 }
@@ -65,7 +66,7 @@ func (c *Config) SetApplicationProtos(protos []byte) error {
 	err := C.quiche_config_set_application_protos((*C.quiche_config)(c),
 		cbytes(protos), clen(protos))
 	if err != 0 {
-		return Error(err)
+		return toError(int(err))
 	}
 	return nil
 }
@@ -4,17 +4,76 @@ package quiche
 #include <stdlib.h>
 #include <sys/types.h>
 #include "quiche.h"
+
+// Results are returned by value so that Go does not need to pass pointers
+// to its local variables, which would move them to the heap.
+
+typedef struct {
+	ssize_t n;
+	bool fin;
+} stream_recv_result;
+
+static inline stream_recv_result stream_recv(quiche_conn *conn, uint64_t stream_id,
+                                             uint8_t *out, size_t out_len) {
+	stream_recv_result r;
+	r.fin = false;
+	r.n = quiche_conn_stream_recv(conn, stream_id, out, out_len, &r.fin);
+	return r;
+}
+
+typedef struct {
+	bool ok;
+	uint64_t stream_id;
+} readable_next_result;
+
+static inline readable_next_result readable_next(quiche_conn *conn) {
+	readable_next_result r;
+	r.stream_id = 0;
+	r.ok = quiche_readable_next(conn, &r.stream_id);
+	return r;
+}
+
+typedef struct {
+	uint8_t *out;
+	size_t out_len;
+} application_proto_result;
+
+static inline application_proto_result application_proto(quiche_conn *conn) {
+	application_proto_result r;
+	r.out = NULL;
+	r.out_len = 0;
+	quiche_conn_application_proto(conn, &r.out, &r.out_len);
+	return r;
+}
+
+static inline quiche_stats conn_stats(quiche_conn *conn) {
+	quiche_stats s;
+	quiche_conn_stats(conn, &s);
+	return s;
+}
 */
 import "C"
 import (
 	"fmt"
+	"sync"
 	"time"
 	"unsafe"
 )
 
-// Connection is a QUIC connection.
+// Connection is a QUIC connection. Errors of its operations, other than
+// ErrDone, are *OpError wrapping an Error, or *CloseError when the operation
+// failed because the connection has been closed.
 type Connection C.quiche_conn
 
+// closeErrors are errors of connections closed locally, which are returned by
+// operations after closure. Connection is a C object so it can not keep them.
+var closeErrors = struct {
+	sync.Mutex
+	m map[*Connection]*CloseError
+}{
+	m: make(map[*Connection]*CloseError),
+}
+
 // Accept creates a new server-side connection.
 func Accept(scid []byte, odcid []byte, config *Config) *Connection {
 	// odcid is optional
@@ -50,7 +109,7 @@ func (c *Connection) Recv(b []byte) (int, error) {
 	n := C.quiche_conn_recv((*C.quiche_conn)(c),
 		cbytes(b), clen(b))
 	if n < 0 {
-		return 0, Error(n)
+		return 0, c.opError(int(n), OpRecv, 0)
 	}
 	return int(n), nil
 }
@@ -60,22 +119,20 @@ func (c *Connection) Send(b []byte) (int, error) {
 	n := C.quiche_conn_send((*C.quiche_conn)(c),
 		cbytes(b), clen(b))
 	if n < 0 {
-		return 0, Error(n)
+		return 0, c.opError(int(n), OpSend, 0)
 	}
 	return int(n), nil
 }
 
 // StreamRecv reads contiguous data from a stream.
 func (c *Connection) StreamRecv(streamID uint64, b []byte) (int, bool, error) {
-	var fin C.bool
-	n := C.quiche_conn_stream_recv((*C.quiche_conn)(c),
+	r := C.stream_recv((*C.quiche_conn)(c),
 		C.uint64_t(streamID),
-		cbytes(b), clen(b),
-		&fin)
-	if n < 0 {
-		return 0, false, Error(n)
+		cbytes(b), clen(b))
+	if r.n < 0 {
+		return 0, false, c.opError(int(r.n), OpStreamRecv, streamID)
 	}
-	return int(n), bool(fin), nil
+	return int(r.n), bool(r.fin), nil
 }
 
 // StreamSend writes data to a stream.
@@ -85,7 +142,7 @@ func (c *Connection) StreamSend(streamID uint64, b []byte, fin bool) (int, error
 		cbytes(b), clen(b),
 		C.bool(fin))
 	if n < 0 {
-		return 0, Error(n)
+		return 0, c.opError(int(n), OpStreamSend, streamID)
 	}
 	return int(n), nil
 }
@@ -105,7 +162,7 @@ func (c *Connection) StreamShutdown(streamID uint64, direction Shutdown, err uin
 		C.enum_quiche_shutdown(direction),
 		C.uint64_t(err))
 	if n < 0 {
-		return Error(n)
+		return c.opError(int(n), OpStreamShutdown, streamID)
 	}
 	return nil
 }
@@ -118,10 +175,9 @@ func (c *Connection) StreamFinished(streamID uint64) bool {
 // ReadableNext fetches the next stream that has outstanding data to read. Returns false if
 // there are no readable streams.
 func (c *Connection) ReadableNext() (uint64, bool) {
-	var streamID C.uint64_t
-	next := C.quiche_readable_next((*C.quiche_conn)(c), &streamID)
-	if next {
-		return uint64(streamID), true
+	r := C.readable_next((*C.quiche_conn)(c))
+	if r.ok {
+		return uint64(r.stream_id), true
 	}
 	return 0, false
 }
@@ -143,20 +199,67 @@ func (c *Connection) Close(app bool, errCode uint16, reason []byte) error {
 		C.uint16_t(errCode),
 		cbytes(reason), clen(reason))
 	if n < 0 {
-		return Error(n)
+		return wrapError(toError(int(n)), OpClose, 0)
 	}
+	closeErrors.Lock()
+	if _, ok := closeErrors.m[c]; !ok {
+		closeErrors.m[c] = &CloseError{
+			App:    app,
+			Code:   errCode,
+			Reason: string(reason),
+		}
+	}
+	closeErrors.Unlock()
 	return nil
 }
 
+// CloseError returns the error of closing the connection, or nil if it has
+// not been closed. The code and reason are only known when the connection
+// was closed locally with Close.
+func (c *Connection) CloseError() *CloseError {
+	closeErrors.Lock()
+	err := closeErrors.m[c]
+	closeErrors.Unlock()
+	if err == nil && c.IsClosed() {
+		err = &CloseError{Remote: true}
+	}
+	return err
+}
+
+// opError returns the error of the operation from the code returned by quiche.
+// ErrInvalidState is replaced with the close error if the connection is closed.
+func (c *Connection) opError(n int, op string, streamID uint64) error {
+	err := toError(n)
+	if err == ErrInvalidState && c.IsClosed() {
+		return c.CloseError()
+	}
+	return wrapError(err, op, streamID)
+}
+
+// CloseWithError closes the connection with the transport error and reason.
+func (c *Connection) CloseWithError(code TransportErrorCode, reason string) error {
+	return c.Close(false, uint16(code), []byte(reason))
+}
+
+// CloseApplication closes the connection with the application error and reason.
+func (c *Connection) CloseApplication(code ApplicationErrorCode, reason string) error {
+	return c.Close(true, uint16(code), []byte(reason))
+}
+
 // ApplicationProto returns the negotiated ALPN protocol.
 func (c *Connection) ApplicationProto() []byte {
-	var out *C.uint8_t
-	var outLen C.size_t
-	C.quiche_conn_application_proto((*C.quiche_conn)(c), &out, &outLen)
-	if outLen <= 0 {
-		return nil
+	return c.AppendApplicationProto(nil)
+}
+
+// AppendApplicationProto appends the negotiated ALPN protocol to b and returns
+// the extended buffer. It does not allocate when b has enough capacity.
+func (c *Connection) AppendApplicationProto(b []byte) []byte {
+	r := C.application_proto((*C.quiche_conn)(c))
+	if r.out_len <= 0 {
+		return b
 	}
-	return C.GoBytes(unsafe.Pointer(out), C.int(outLen))
+	proto := (*[1 << 30]byte)(unsafe.Pointer(r.out))[:r.out_len:r.out_len]
+	return append(b, proto...)
 }
 
 // IsEstablished returns true if the connection handshake is complete.
@@ -171,8 +274,7 @@ func (c *Connection) IsClosed() bool {
 
 // Stats collects and returns statistics about the connection.
 func (c *Connection) Stats(stats *Stats) {
-	var s C.quiche_stats
-	C.quiche_conn_stats((*C.quiche_conn)(c), &s)
+	s := C.conn_stats((*C.quiche_conn)(c))
 	stats.Recv = uint64(s.recv)
 	stats.Sent = uint64(s.sent)
 	stats.Lost = uint64(s.lost)
@@ -182,6 +284,9 @@ func (c *Connection) Stats(stats *Stats) {
 
 // Free frees the connection object.
 func (c *Connection) Free() {
+	closeErrors.Lock()
+	delete(closeErrors.m, c)
+	closeErrors.Unlock()
 	C.quiche_conn_free((*C.quiche_conn)(c))
 }
 
@@ -195,6 +300,6 @@ type Stats struct {
 }
 
 func (s *Stats) String() string {
-	return fmt.Sprintf("recv=%d sent=%d lost=%d rtt=%s",
-		s.Recv, s.Sent, s.Lost, s.RTT)
+	return fmt.Sprintf("recv=%d sent=%d lost=%d rtt=%s cwnd=%d",
+		s.Recv, s.Sent, s.Lost, s.RTT, s.CWnd)
 }
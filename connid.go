@@ -0,0 +1,271 @@
+package quiche
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// ErrUnknownConnIDConfig is returned when a connection ID was not generated
+// with the configuration known by a ServerIDDecoder.
+var ErrUnknownConnIDConfig = errors.New("connection ID config is unknown")
+
+// minConnIDNonceLen is the minimum number of random bytes in a routable
+// connection ID, so that connection IDs from the same server are unique.
+const minConnIDNonceLen = 4
+
+// minConnIDLen is the minimum length of a non-empty connection ID which can be
+// encoded in the DCIL and SCIL fields of long header packets.
+const minConnIDLen = 4
+
+// MaxConnIDConfigID is the largest config rotation codepoint of routable
+// connection IDs. Value 3 is reserved for unroutable connection IDs.
+const MaxConnIDConfigID = 2
+
+// ConnectionIDGenerator generates source connection IDs for new connections.
+type ConnectionIDGenerator interface {
+	// NewConnectionID returns a new connection ID.
+	NewConnectionID() ([]byte, error)
+	// ConnectionIDLen returns length of connection IDs it generates, which
+	// is needed to parse short header packets.
+	ConnectionIDLen() int
+}
+
+type randomConnectionIDGenerator struct {
+	length int
+}
+
+// NewRandomConnectionIDGenerator returns a generator that creates random
+// connection IDs of the given length, which must be between 4 and MaxConnIDLen.
+func NewRandomConnectionIDGenerator(length int) (ConnectionIDGenerator, error) {
+	if length < minConnIDLen || length > MaxConnIDLen {
+		return nil, fmt.Errorf("connection ID length is invalid: %d", length)
+	}
+	return &randomConnectionIDGenerator{length: length}, nil
+}
+
+func (g *randomConnectionIDGenerator) NewConnectionID() ([]byte, error) {
+	b := make([]byte, g.length)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (g *randomConnectionIDGenerator) ConnectionIDLen() int {
+	return g.length
+}
+
+// PlaintextConnectionIDGenerator generates connection IDs carrying the server ID
+// in clear, following the QUIC-LB plaintext algorithm:
+//
+//	first octet | server ID | random nonce
+//
+// The two high bits of the first octet are the config rotation codepoint and
+// the remaining bits encode the length of the connection ID.
+type PlaintextConnectionIDGenerator struct {
+	configID uint8
+	serverID []byte
+	length   int
+}
+
+// NewPlaintextConnectionIDGenerator creates a generator for connection IDs of the
+// given length which include serverID.
+func NewPlaintextConnectionIDGenerator(configID uint8, serverID []byte, length int) (*PlaintextConnectionIDGenerator, error) {
+	if configID > MaxConnIDConfigID {
+		return nil, fmt.Errorf("connection ID config is invalid: %d", configID)
+	}
+	if len(serverID) == 0 {
+		return nil, errors.New("server ID is required")
+	}
+	if length > MaxConnIDLen || length < 1+len(serverID)+minConnIDNonceLen {
+		return nil, fmt.Errorf("connection ID length is invalid: %d", length)
+	}
+	return &PlaintextConnectionIDGenerator{
+		configID: configID,
+		serverID: append([]byte(nil), serverID...),
+		length:   length,
+	}, nil
+}
+
+// NewConnectionID returns a new connection ID.
+func (g *PlaintextConnectionIDGenerator) NewConnectionID() ([]byte, error) {
+	b := make([]byte, g.length)
+	n := copy(b[1:], g.serverID) + 1
+	_, err := rand.Read(b[n:])
+	if err != nil {
+		return nil, err
+	}
+	b[0] = connIDFirstOctet(g.configID, g.length)
+	return b, nil
+}
+
+// ConnectionIDLen returns length of generated connection IDs.
+func (g *PlaintextConnectionIDGenerator) ConnectionIDLen() int {
+	return g.length
+}
+
+// EncryptedConnectionIDGenerator generates connection IDs with the server ID
+// encrypted, following the QUIC-LB block cipher algorithm:
+//
+//	first octet | AES(server ID | random nonce)
+//
+// Generated connection IDs are always 17 bytes long.
+type EncryptedConnectionIDGenerator struct {
+	configID uint8
+	serverID []byte
+	block    cipher.Block
+}
+
+// NewEncryptedConnectionIDGenerator creates a generator for connection IDs which
+// include serverID encrypted with the given AES key.
+func NewEncryptedConnectionIDGenerator(configID uint8, serverID []byte, key []byte) (*EncryptedConnectionIDGenerator, error) {
+	if configID > MaxConnIDConfigID {
+		return nil, fmt.Errorf("connection ID config is invalid: %d", configID)
+	}
+	if len(serverID) == 0 || len(serverID) > aes.BlockSize-minConnIDNonceLen {
+		return nil, fmt.Errorf("server ID length is invalid: %d", len(serverID))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedConnectionIDGenerator{
+		configID: configID,
+		serverID: append([]byte(nil), serverID...),
+		block:    block,
+	}, nil
+}
+
+// NewConnectionID returns a new connection ID.
+func (g *EncryptedConnectionIDGenerator) NewConnectionID() ([]byte, error) {
+	var plain [aes.BlockSize]byte
+	n := copy(plain[:], g.serverID)
+	_, err := rand.Read(plain[n:])
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 1+aes.BlockSize)
+	b[0] = connIDFirstOctet(g.configID, len(b))
+	g.block.Encrypt(b[1:], plain[:])
+	return b, nil
+}
+
+// ConnectionIDLen returns length of generated connection IDs.
+func (g *EncryptedConnectionIDGenerator) ConnectionIDLen() int {
+	return 1 + aes.BlockSize
+}
+
+func connIDFirstOctet(configID uint8, length int) byte {
+	return configID<<6 | byte(length-1)&0x3f
+}
+
+// ServerIDDecoder extracts server IDs from connection IDs created by
+// PlaintextConnectionIDGenerator or EncryptedConnectionIDGenerator.
+// It is intended to be used by load balancers.
+type ServerIDDecoder struct {
+	configID    uint8
+	serverIDLen int
+	connIDLen   int
+	block       cipher.Block
+}
+
+// NewPlaintextServerIDDecoder creates a decoder for plaintext connection IDs.
+func NewPlaintextServerIDDecoder(configID uint8, serverIDLen, connIDLen int) (*ServerIDDecoder, error) {
+	if configID > MaxConnIDConfigID {
+		return nil, fmt.Errorf("connection ID config is invalid: %d", configID)
+	}
+	if serverIDLen <= 0 {
+		return nil, fmt.Errorf("server ID length is invalid: %d", serverIDLen)
+	}
+	if connIDLen > MaxConnIDLen || connIDLen < 1+serverIDLen+minConnIDNonceLen {
+		return nil, fmt.Errorf("connection ID length is invalid: %d", connIDLen)
+	}
+	return &ServerIDDecoder{
+		configID:    configID,
+		serverIDLen: serverIDLen,
+		connIDLen:   connIDLen,
+	}, nil
+}
+
+// NewEncryptedServerIDDecoder creates a decoder for encrypted connection IDs.
+func NewEncryptedServerIDDecoder(configID uint8, serverIDLen int, key []byte) (*ServerIDDecoder, error) {
+	if configID > MaxConnIDConfigID {
+		return nil, fmt.Errorf("connection ID config is invalid: %d", configID)
+	}
+	if serverIDLen <= 0 || serverIDLen > aes.BlockSize-minConnIDNonceLen {
+		return nil, fmt.Errorf("server ID length is invalid: %d", serverIDLen)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerIDDecoder{
+		configID:    configID,
+		serverIDLen: serverIDLen,
+		connIDLen:   1 + aes.BlockSize,
+		block:       block,
+	}, nil
+}
+
+// ConnectionIDLen returns length of connection IDs which can be decoded.
+func (d *ServerIDDecoder) ConnectionIDLen() int {
+	return d.connIDLen
+}
+
+// ServerID returns the server ID encoded in connID.
+func (d *ServerIDDecoder) ServerID(connID []byte) ([]byte, error) {
+	if len(connID) != d.connIDLen {
+		return nil, ErrUnknownConnIDConfig
+	}
+	if connID[0] != connIDFirstOctet(d.configID, d.connIDLen) {
+		return nil, ErrUnknownConnIDConfig
+	}
+	if d.block == nil {
+		return append([]byte(nil), connID[1:1+d.serverIDLen]...), nil
+	}
+	var plain [aes.BlockSize]byte
+	d.block.Decrypt(plain[:], connID[1:])
+	return append([]byte(nil), plain[:d.serverIDLen]...), nil
+}
+
+// PacketServerID returns the server ID encoded in the destination connection ID
+// of the raw QUIC packet in b.
+func (d *ServerIDDecoder) PacketServerID(b []byte) ([]byte, error) {
+	dcid, err := PacketDCID(b, d.connIDLen)
+	if err != nil {
+		return nil, err
+	}
+	return d.ServerID(dcid)
+}
+
+// PacketDCID returns the destination connection ID of the raw QUIC packet in b
+// without decrypting it. dcidLength is the length of connection ID in short
+// header packets. The returned slice refers to b.
+func PacketDCID(b []byte, dcidLength int) ([]byte, error) {
+	if len(b) < 1 {
+		return nil, ErrBufferTooShort
+	}
+	if b[0]&0x80 == 0 {
+		// Short header
+		if len(b) < 1+dcidLength {
+			return nil, ErrBufferTooShort
+		}
+		return b[1 : 1+dcidLength], nil
+	}
+	// Long header: type, version, DCIL | SCIL, DCID
+	if len(b) < 6 {
+		return nil, ErrBufferTooShort
+	}
+	dcil := int(b[5] >> 4)
+	if dcil > 0 {
+		dcil += minConnIDLen - 1
+	}
+	if len(b) < 6+dcil {
+		return nil, ErrBufferTooShort
+	}
+	return b[6 : 6+dcil], nil
+}
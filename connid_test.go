@@ -0,0 +1,117 @@
+package quiche
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRandomConnectionID(t *testing.T) {
+	// Lengths 1 to 3 can not be encoded in long header packets.
+	for _, length := range []int{-1, 0, 1, 3, MaxConnIDLen + 1} {
+		_, err := NewRandomConnectionIDGenerator(length)
+		if err == nil {
+			t.Fatalf("expect error for length %d", length)
+		}
+	}
+	for _, length := range []int{4, MaxConnIDLen} {
+		gen, err := NewRandomConnectionIDGenerator(length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gen.ConnectionIDLen() != length {
+			t.Fatalf("unexpected length: want %d, actual %d", length, gen.ConnectionIDLen())
+		}
+		cid1 := newTestConnID(t, gen)
+		cid2 := newTestConnID(t, gen)
+		if bytes.Equal(cid1, cid2) {
+			t.Fatalf("connection ids must be unique: %x", cid1)
+		}
+	}
+}
+
+func TestPlaintextConnectionID(t *testing.T) {
+	serverID := []byte{0x12, 0x34}
+	gen, err := NewPlaintextConnectionIDGenerator(1, serverID, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := NewPlaintextServerIDDecoder(1, len(serverID), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cid1 := newTestConnID(t, gen)
+	cid2 := newTestConnID(t, gen)
+	if bytes.Equal(cid1, cid2) {
+		t.Fatalf("connection ids must be unique: %x", cid1)
+	}
+	sid, err := dec.ServerID(cid1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(serverID, sid) {
+		t.Fatalf("unexpected server id: want %x, actual %x", serverID, sid)
+	}
+	other, err := NewPlaintextServerIDDecoder(2, len(serverID), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.ServerID(cid1)
+	if err != ErrUnknownConnIDConfig {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestEncryptedConnectionID(t *testing.T) {
+	serverID := []byte{0x12, 0x34, 0x56}
+	key := []byte("0123456789abcdef")
+	gen, err := NewEncryptedConnectionIDGenerator(0, serverID, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := NewEncryptedServerIDDecoder(0, len(serverID), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cid := newTestConnID(t, gen)
+	if len(cid) != gen.ConnectionIDLen() {
+		t.Fatalf("unexpected connection id length: %d", len(cid))
+	}
+	if bytes.Contains(cid, serverID) {
+		t.Fatalf("server id is not encrypted: %x", cid)
+	}
+	// Short header
+	packet := append([]byte{0x40}, cid...)
+	packet = append(packet, 0xff, 0xff)
+	sid, err := dec.PacketServerID(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(serverID, sid) {
+		t.Fatalf("unexpected server id: want %x, actual %x", serverID, sid)
+	}
+	// Long header
+	packet = []byte{0xc0, 0xff, 0x00, 0x00, 0x14, byte(len(cid)-3) << 4}
+	packet = append(packet, cid...)
+	sid, err = dec.PacketServerID(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(serverID, sid) {
+		t.Fatalf("unexpected server id: want %x, actual %x", serverID, sid)
+	}
+	_, err = dec.PacketServerID(packet[:10])
+	if err != ErrBufferTooShort {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func newTestConnID(t *testing.T, gen ConnectionIDGenerator) []byte {
+	cid, err := gen.NewConnectionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cid) != gen.ConnectionIDLen() {
+		t.Fatalf("unexpected connection id length: want %d, actual %d", gen.ConnectionIDLen(), len(cid))
+	}
+	return cid
+}
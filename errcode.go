@@ -0,0 +1,98 @@
+package quiche
+
+import (
+	"fmt"
+)
+
+// TransportErrorCode is an error code sent in a CONNECTION_CLOSE frame of
+// QUIC transport type.
+type TransportErrorCode uint16
+
+// Transport error codes defined in draft-ietf-quic-transport-20.
+const (
+	NoError                 TransportErrorCode = 0x0 // The connection is closed abruptly without any error.
+	InternalError           TransportErrorCode = 0x1 // The endpoint encountered an internal error.
+	ServerBusy              TransportErrorCode = 0x2 // The server is currently busy.
+	FlowControlError        TransportErrorCode = 0x3 // The peer received more data than it permitted.
+	StreamLimitError        TransportErrorCode = 0x4 // Too many streams were opened.
+	StreamStateError        TransportErrorCode = 0x5 // A frame was received for a stream in an invalid state.
+	FinalSizeError          TransportErrorCode = 0x6 // A stream's final size was changed or exceeded.
+	FrameEncodingError      TransportErrorCode = 0x7 // A frame was badly formatted.
+	TransportParameterError TransportErrorCode = 0x8 // Transport parameters were invalid.
+	VersionNegotiationError TransportErrorCode = 0x9 // Version negotiation was invalid.
+	ProtocolViolation       TransportErrorCode = 0xa // A generic protocol violation.
+	InvalidMigration        TransportErrorCode = 0xc // The peer migrated when it was not permitted.
+	CryptoErrorBase         TransportErrorCode = 0x100
+)
+
+var transportErrorNames = map[TransportErrorCode]string{
+	NoError:                 "NO_ERROR",
+	InternalError:           "INTERNAL_ERROR",
+	ServerBusy:              "SERVER_BUSY",
+	FlowControlError:        "FLOW_CONTROL_ERROR",
+	StreamLimitError:        "STREAM_LIMIT_ERROR",
+	StreamStateError:        "STREAM_STATE_ERROR",
+	FinalSizeError:          "FINAL_SIZE_ERROR",
+	FrameEncodingError:      "FRAME_ENCODING_ERROR",
+	TransportParameterError: "TRANSPORT_PARAMETER_ERROR",
+	VersionNegotiationError: "VERSION_NEGOTIATION_ERROR",
+	ProtocolViolation:       "PROTOCOL_VIOLATION",
+	InvalidMigration:        "INVALID_MIGRATION",
+}
+
+// CryptoError returns the transport error code of the TLS alert.
+func CryptoError(alert uint8) TransportErrorCode {
+	return CryptoErrorBase + TransportErrorCode(alert)
+}
+
+// IsCryptoError returns true if the code carries a TLS alert.
+func (c TransportErrorCode) IsCryptoError() bool {
+	return c >= CryptoErrorBase && c <= CryptoErrorBase+0xff
+}
+
+func (c TransportErrorCode) String() string {
+	if name, ok := transportErrorNames[c]; ok {
+		return name
+	}
+	if c.IsCryptoError() {
+		return fmt.Sprintf("CRYPTO_ERROR(0x%x)", uint16(c-CryptoErrorBase))
+	}
+	return fmt.Sprintf("0x%x", uint16(c))
+}
+
+// ApplicationErrorCode is an error code defined by the application protocol,
+// sent in a CONNECTION_CLOSE frame of application type.
+type ApplicationErrorCode uint16
+
+func (c ApplicationErrorCode) String() string {
+	return fmt.Sprintf("0x%x", uint16(c))
+}
+
+// CloseError is returned by connection and stream operations which failed
+// because the connection has been closed, instead of ErrInvalidState. The code
+// and reason are only known for connections closed locally.
+type CloseError struct {
+	// Remote is true when the connection was closed by the peer or timed out.
+	Remote bool
+	// App is true if Code is an ApplicationErrorCode, otherwise it is a
+	// TransportErrorCode.
+	App    bool
+	Code   uint16
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Remote {
+		return "connection closed by peer or timed out"
+	}
+	var code fmt.Stringer = TransportErrorCode(e.Code)
+	typ := "transport"
+	if e.App {
+		code = ApplicationErrorCode(e.Code)
+		typ = "application"
+	}
+	if e.Reason == "" {
+		return fmt.Sprintf("connection closed locally: %s error %v", typ, code)
+	}
+	return fmt.Sprintf("connection closed locally: %s error %v: %s", typ, code, e.Reason)
+}
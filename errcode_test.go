@@ -0,0 +1,42 @@
+package quiche
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTransportErrorCode(t *testing.T) {
+	tests := []struct {
+		code TransportErrorCode
+		str  string
+	}{
+		{NoError, "NO_ERROR"},
+		{ProtocolViolation, "PROTOCOL_VIOLATION"},
+		{CryptoError(0x28), "CRYPTO_ERROR(0x28)"},
+		{VersionNegotiationError, "VERSION_NEGOTIATION_ERROR"},
+		{TransportErrorCode(0xb), "0xb"},
+	}
+	for _, tt := range tests {
+		if tt.code.String() != tt.str {
+			t.Errorf("unexpected string of %d: want %s, actual %s", uint16(tt.code), tt.str, tt.code)
+		}
+	}
+	if !CryptoError(0).IsCryptoError() || InternalError.IsCryptoError() {
+		t.Error("unexpected crypto error")
+	}
+}
+
+func TestCloseError(t *testing.T) {
+	var err error = &CloseError{Code: uint16(FlowControlError), Reason: "too much"}
+	if err.Error() != "connection closed locally: transport error FLOW_CONTROL_ERROR: too much" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = &CloseError{App: true, Code: 0x10}
+	if err.Error() != "connection closed locally: application error 0x10" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var closeErr *CloseError
+	if !errors.As(&CloseError{Remote: true}, &closeErr) || !closeErr.Remote {
+		t.Fatalf("unexpected close error: %v", closeErr)
+	}
+}
@@ -0,0 +1,151 @@
+package quiche
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Operations reported in OpError.
+const (
+	OpRecv           = "recv"
+	OpSend           = "send"
+	OpStreamRecv     = "stream_recv"
+	OpStreamSend     = "stream_send"
+	OpStreamShutdown = "stream_shutdown"
+	OpClose          = "close"
+	// OpH3SendRequest is sending an HTTP/3 request, whose stream is not known.
+	OpH3SendRequest = "h3_send_request"
+)
+
+// OpError is an error of a connection operation. It wraps an Error so that
+// errors.Is(err, ErrInvalidStreamState) still matches.
+//
+// ErrDone is never wrapped as it is returned in normal operation, so it can
+// still be compared with ==.
+type OpError struct {
+	Op string
+	// StreamID is only set for stream operations.
+	StreamID uint64
+	// ConnID is the source connection ID. It is only set by TracedConnection
+	// as Connection does not know its ID.
+	ConnID []byte
+	Err    error
+}
+
+func (e *OpError) Error() string {
+	s := e.Op
+	if e.isStreamOp() {
+		s += fmt.Sprintf(" stream %d", e.StreamID)
+	}
+	if len(e.ConnID) > 0 {
+		s += fmt.Sprintf(" conn %x", e.ConnID)
+	}
+	return s + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+func (e *OpError) isStreamOp() bool {
+	switch e.Op {
+	case OpStreamRecv, OpStreamSend, OpStreamShutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// Fatal returns true if the connection can not be used anymore. Errors of
+// stream operations only affect the stream, unless the connection is in an
+// invalid state or its cryptographic operations failed.
+func (e *OpError) Fatal() bool {
+	var h3Err H3Error
+	if errors.As(e.Err, &h3Err) {
+		return h3Err.Fatal()
+	}
+	var code Error
+	if !errors.As(e.Err, &code) {
+		return false
+	}
+	if !e.isStreamOp() {
+		return code.Fatal()
+	}
+	switch code {
+	case ErrInvalidState, ErrCryptoFail, ErrTLSFail:
+		return true
+	default:
+		return false
+	}
+}
+
+// wrapError returns err with the operation context unless it is ErrDone.
+func wrapError(err error, op string, streamID uint64) error {
+	if err == ErrDone {
+		return err
+	}
+	return &OpError{
+		Op:       op,
+		StreamID: streamID,
+		Err:      err,
+	}
+}
+
+// Temporary returns true if the operation can be retried later, or with a
+// larger buffer.
+func (e Error) Temporary() bool {
+	return e == ErrDone || e == ErrBufferTooShort
+}
+
+// Fatal returns true if the connection can not be used anymore after a
+// connection operation, such as Recv or Send, failed with e. Stream
+// operations are classified by OpError.Fatal.
+func (e Error) Fatal() bool {
+	switch e {
+	case ErrDone, ErrBufferTooShort, ErrInvalidStreamState:
+		return false
+	default:
+		return true
+	}
+}
+
+// IsTemporary returns true if err does not indicate a failure: the
+// operation can be retried when the connection has more work to do, e.g.
+// after receiving packets.
+func IsTemporary(err error) bool {
+	var h3Err H3Error
+	if errors.As(err, &h3Err) {
+		return h3Err.Temporary()
+	}
+	var e Error
+	return errors.As(err, &e) && e.Temporary()
+}
+
+// IsFatal returns true if err requires tearing down the connection, because
+// it has been closed or the peer violated the protocol.
+// Errors which are neither temporary nor fatal, such as
+// ErrInvalidStreamState or ErrFinalSize returned by a stream operation, only
+// affect the stream and it can be reset.
+func IsFatal(err error) bool {
+	if err == nil {
+		return false
+	}
+	var closeErr *CloseError
+	if errors.As(err, &closeErr) {
+		return true
+	}
+	var opErr *OpError
+	if errors.As(err, &opErr) {
+		return opErr.Fatal()
+	}
+	var h3Err H3Error
+	if errors.As(err, &h3Err) {
+		return h3Err.Fatal()
+	}
+	var e Error
+	if errors.As(err, &e) {
+		return e.Fatal()
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package quiche
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestOpError(t *testing.T) {
+	if wrapError(ErrDone, OpSend, 0) != ErrDone {
+		t.Fatal("ErrDone must not be wrapped")
+	}
+	err := wrapError(ErrInvalidStreamState, OpStreamSend, 4)
+	if !errors.Is(err, ErrInvalidStreamState) || errors.Is(err, ErrDone) {
+		t.Fatalf("unexpected wrapped error: %v", err)
+	}
+	var opErr *OpError
+	if !errors.As(err, &opErr) || opErr.Op != OpStreamSend || opErr.StreamID != 4 {
+		t.Fatalf("unexpected operation error: %#v", opErr)
+	}
+	want := "stream_send stream 4: " + ErrInvalidStreamState.Error()
+	if err.Error() != want || opErr.ConnID != nil {
+		t.Fatalf("unexpected error: want %q, actual %q", want, err)
+	}
+	// Only TracedConnection knows the connection ID.
+	traced := &TracedConnection{id: []byte{0xab, 0xcd}}
+	err = traced.withID(err)
+	want = "stream_send stream 4 conn abcd: " + ErrInvalidStreamState.Error()
+	if err.Error() != want {
+		t.Fatalf("unexpected error: want %q, actual %q", want, err)
+	}
+	err = wrapError(ErrInvalidPacket, OpRecv, 0)
+	if err.Error() != "recv: "+ErrInvalidPacket.Error() {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestErrorPredicates(t *testing.T) {
+	tests := []struct {
+		err       error
+		temporary bool
+		fatal     bool
+	}{
+		{nil, false, false},
+		{ErrDone, true, false},
+		{wrapError(ErrBufferTooShort, OpStreamRecv, 0), true, false},
+		{wrapError(ErrInvalidStreamState, OpStreamSend, 0), false, false},
+		{wrapError(ErrInvalidState, OpSend, 0), false, true},
+		{wrapError(ErrFlowControl, OpRecv, 0), false, true},
+		// Stream operations only fail the stream unless the connection is broken.
+		{wrapError(ErrStreamLimit, OpStreamSend, 12), false, false},
+		{wrapError(ErrFinalSize, OpStreamSend, 4), false, false},
+		{wrapError(ErrFlowControl, OpStreamRecv, 4), false, false},
+		{wrapError(ErrInvalidState, OpStreamRecv, 4), false, true},
+		{wrapError(ErrTLSFail, OpStreamShutdown, 4), false, true},
+		{fmt.Errorf("request: %w", wrapError(ErrFinalSize, OpStreamSend, 4)), false, false},
+		{fmt.Errorf("send: %w", ErrTLSFail), false, true},
+		{&CloseError{Remote: true}, false, true},
+		// HTTP/3 errors are classified by their own codes.
+		{wrapError(toH3Error(int(ErrDone)), OpStreamRecv, 0), true, false},
+		{wrapError(H3ErrStreamBlocked, OpStreamSend, 0), true, false},
+		{wrapError(H3ErrTransport, OpH3SendRequest, 0), false, false},
+		{wrapError(H3ErrFrameUnexpected, OpStreamRecv, 0), false, true},
+		{H3ErrClosedCriticalStream, false, true},
+		{errors.New("other"), false, false},
+	}
+	for _, tt := range tests {
+		if IsTemporary(tt.err) != tt.temporary || IsFatal(tt.err) != tt.fatal {
+			t.Errorf("unexpected predicates of %v: temporary %v, fatal %v",
+				tt.err, IsTemporary(tt.err), IsFatal(tt.err))
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package quiche
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateFuzzCorpus = flag.Bool("update-fuzz-corpus", false, "write datagrams of a handshake to the seed corpus in testdata/fuzz")
+
+// TestFuzzCorpus adds datagrams sent by the client and the server during a
+// handshake, and stream data sent by a HTTP/3 client, to the seed corpus of
+// the fuzz targets parsing them.
+func TestFuzzCorpus(t *testing.T) {
+	if !*updateFuzzCorpus {
+		t.Skip("seed corpus is only written with -update-fuzz-corpus")
+	}
+	client, server := handshakeDatagrams(t)
+	for i, b := range client {
+		name := fmt.Sprintf("handshake-client-%d", i)
+		writeFuzzCorpus(t, "FuzzHeaderInfo", name, b, "int(4)")
+		writeFuzzCorpus(t, "FuzzPacketDCID", name, b, `byte('\x04')`)
+		writeFuzzCorpus(t, "FuzzServerRecv", name, b)
+	}
+	for i, b := range server {
+		name := fmt.Sprintf("handshake-server-%d", i)
+		writeFuzzCorpus(t, "FuzzHeaderInfo", name, b, "int(4)")
+		writeFuzzCorpus(t, "FuzzPacketDCID", name, b, `byte('\x04')`)
+		writeFuzzCorpus(t, "FuzzClientRecv", name, b)
+	}
+	streams := h3StreamData(t)
+	writeFuzzCorpus(t, "FuzzH3Poll", "h3-client-request", streams[0], "bool(false)")
+	for id, b := range streams {
+		if id&0x2 != 0 {
+			name := fmt.Sprintf("h3-client-uni-%d", id)
+			writeFuzzCorpus(t, "FuzzH3Poll", name, b, "bool(true)")
+		}
+	}
+}
+
+// writeFuzzCorpus writes a seed corpus entry whose first argument is b and
+// other arguments are encoded in args.
+func writeFuzzCorpus(t *testing.T, target, name string, b []byte, args ...string) {
+	dir := filepath.Join("testdata", "fuzz", target)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := fmt.Sprintf("go test fuzz v1\n[]byte(%q)\n", b)
+	if len(args) > 0 {
+		data += strings.Join(args, "\n") + "\n"
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshakeDatagrams returns datagrams sent by the client and the server
+// during a handshake.
+func handshakeDatagrams(tb testing.TB) (client, server [][]byte) {
+	p := newConnPair(tb, nil)
+	defer p.free()
+	c, s := p.client, p.server
+
+	buf := make([]byte, 65535)
+	record := func(src, dst *Connection, out *[][]byte) int {
+		packets := 0
+		for {
+			n, err := src.Send(buf)
+			if err == ErrDone {
+				return packets
+			}
+			if err != nil {
+				tb.Fatal(err)
+			}
+			*out = append(*out, append([]byte(nil), buf[:n]...))
+			_, err = dst.Recv(buf[:n])
+			if err != nil && err != ErrDone {
+				tb.Fatal(err)
+			}
+			packets++
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if record(c, s, &client)+record(s, c, &server) == 0 {
+			break
+		}
+	}
+	if !c.IsEstablished() || !s.IsEstablished() {
+		tb.Fatal("connection is not established")
+	}
+	return client, server
+}
+
+// h3StreamData returns data sent by a HTTP/3 client on each stream when
+// making a request with a body.
+func h3StreamData(tb testing.TB) map[uint64][]byte {
+	config := h3FuzzConfig(tb)
+	defer config.Free()
+	h3Config := NewH3Config(0, 1024, 0, 0)
+	defer h3Config.Free()
+
+	c := Connect("", randomCID(), config)
+	defer c.Free()
+	s := Accept(randomCID(), nil, config)
+	defer s.Free()
+	buf := make([]byte, 65535)
+	err := doHandshake(c, s, buf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ch3 := H3Connect(c, h3Config)
+	if ch3 == nil {
+		tb.Fatal("could not create HTTP/3 client connection")
+	}
+	defer ch3.Free()
+
+	req := []H3Header{
+		{Name: []byte(":method"), Value: []byte("POST")},
+		{Name: []byte(":scheme"), Value: []byte("https")},
+		{Name: []byte(":authority"), Value: []byte("quic.tech")},
+		{Name: []byte(":path"), Value: []byte("/upload")},
+		{Name: []byte("content-type"), Value: []byte("text/plain")},
+	}
+	streamID, err := ch3.SendRequest(c, req, false)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	_, err = ch3.SendBody(c, streamID, []byte("hello"), true)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	_, err = pipe(c, s, buf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	// The server reads streams as a plain QUIC connection to get data
+	// exactly as sent by the client.
+	streams := make(map[uint64][]byte)
+	for {
+		id, ok := s.ReadableNext()
+		if !ok {
+			break
+		}
+		for {
+			n, _, err := s.StreamRecv(id, buf)
+			if err == ErrDone {
+				break
+			}
+			if err != nil {
+				tb.Fatal(err)
+			}
+			streams[id] = append(streams[id], buf[:n]...)
+		}
+	}
+	if len(streams[streamID]) == 0 {
+		tb.Fatal("request is not received")
+	}
+	return streams
+}
+
+// h3FuzzConfig returns a configuration for HTTP/3 fuzz targets.
+func h3FuzzConfig(tb testing.TB) *Config {
+	config, err := defaultConfig()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = config.SetApplicationProtos([]byte(H3ApplicationProtocol))
+	if err != nil {
+		config.Free()
+		tb.Fatal(err)
+	}
+	config.SetInitialMaxData(1 << 20)
+	config.SetInitialMaxStreamDataBidiLocal(1 << 16)
+	config.SetInitialMaxStreamDataBidiRemote(1 << 16)
+	config.SetInitialMaxStreamDataUni(1 << 16)
+	config.SetInitialMaxStreamsUni(8)
+	return config
+}
+
+// Seed corpora of the fuzz targets are in testdata/fuzz. Datagrams of a
+// handshake and HTTP/3 stream data are added by running TestFuzzCorpus with
+// -update-fuzz-corpus.
+
+func FuzzHeaderInfo(f *testing.F) {
+	f.Fuzz(func(t *testing.T, b []byte, dcidLength int) {
+		var h Header
+		for _, size := range []int{0, 4, MaxConnIDLen} {
+			h.SCID = make([]byte, size)
+			h.DCID = make([]byte, size)
+			h.Token = make([]byte, size)
+			err := HeaderInfo(b, dcidLength, &h)
+			if err != nil {
+				continue
+			}
+			if len(h.SCID) > size || len(h.DCID) > size || len(h.Token) > size {
+				t.Fatalf("header exceeds buffers of %d bytes: %+v", size, h)
+			}
+		}
+	})
+}
+
+// FuzzServerRecv feeds a datagram to a server which has received the client
+// Initial packet.
+func FuzzServerRecv(f *testing.F) {
+	config, err := defaultConfig()
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer config.Free()
+	f.Fuzz(func(t *testing.T, b []byte) {
+		c := Connect("", randomCID(), config)
+		defer c.Free()
+		s := Accept(randomCID(), nil, config)
+		defer s.Free()
+
+		buf := make([]byte, 65535)
+		n, err := c.Send(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Recv(buf[:n])
+		if err != nil && err != ErrDone {
+			t.Fatal(err)
+		}
+		fuzzRecv(s, b, buf)
+	})
+}
+
+// FuzzClientRecv feeds a datagram to a client which has sent its Initial
+// packet.
+func FuzzClientRecv(f *testing.F) {
+	config, err := defaultConfig()
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer config.Free()
+	f.Fuzz(func(t *testing.T, b []byte) {
+		c := Connect("", randomCID(), config)
+		defer c.Free()
+
+		buf := make([]byte, 65535)
+		_, err := c.Send(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fuzzRecv(c, b, buf)
+	})
+}
+
+// fuzzRecv passes a copy of b to the connection and drains what it has to
+// send in response. Errors are expected, only crashes are reported.
+func fuzzRecv(conn *Connection, b []byte, buf []byte) {
+	// Recv may decrypt in place.
+	n := copy(buf, b)
+	conn.Recv(buf[:n])
+	for !conn.IsClosed() {
+		_, err := conn.Send(buf)
+		if err != nil {
+			break
+		}
+	}
+	conn.Timeout()
+}
+
+// FuzzH3Poll sends data on a client stream of an established HTTP/3
+// connection and polls events on the server.
+func FuzzH3Poll(f *testing.F) {
+	config := h3FuzzConfig(f)
+	defer config.Free()
+	h3Config := NewH3Config(0, 1024, 0, 0)
+	defer h3Config.Free()
+
+	f.Fuzz(func(t *testing.T, b []byte, uni bool) {
+		c := Connect("", randomCID(), config)
+		defer c.Free()
+		s := Accept(randomCID(), nil, config)
+		defer s.Free()
+		buf := make([]byte, 65535)
+		err := doHandshake(c, s, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch3 := H3Connect(c, h3Config)
+		if ch3 == nil {
+			t.Fatal("could not create HTTP/3 client connection")
+		}
+		defer ch3.Free()
+		sh3 := H3Accept(s, h3Config)
+		if sh3 == nil {
+			t.Fatal("could not create HTTP/3 server connection")
+		}
+		defer sh3.Free()
+
+		// Stream IDs which are not used by the HTTP/3 connection.
+		streamID := uint64(0)
+		if uni {
+			streamID = 14
+		}
+		_, err = c.StreamSend(streamID, b, true)
+		if err != nil && err != ErrDone {
+			t.Fatal(err)
+		}
+		_, err = pipe(c, s, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			_, ev, err := sh3.Poll(s)
+			if err != nil {
+				break
+			}
+			if ev.Type() == H3EventHeaders {
+				ev.Headers()
+			}
+			ev.Free()
+		}
+	})
+}
+
+func FuzzPacketDCID(f *testing.F) {
+	f.Fuzz(func(t *testing.T, b []byte, dcidLength uint8) {
+		dcid, err := PacketDCID(b, int(dcidLength)%(MaxConnIDLen+1))
+		if err == nil && len(dcid) > MaxConnIDLen {
+			t.Fatalf("connection ID is too long: %x", dcid)
+		}
+		typ := PacketType(b)
+		if typ == "" && len(b) >= 5 {
+			t.Fatalf("no packet type: %x", b)
+		}
+		if scil := packetSCIDLen(b); scil > MaxConnIDLen {
+			t.Fatalf("source connection ID is too long: %d", scil)
+		}
+	})
+}
@@ -0,0 +1,303 @@
+package quiche
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include <sys/types.h>
+#include "quiche.h"
+
+typedef struct {
+	quiche_h3_header *headers;
+	size_t len;
+	size_t cap;
+} h3_header_list;
+
+static int h3_collect_header(uint8_t *name, size_t name_len,
+                             uint8_t *value, size_t value_len,
+                             void *argp) {
+	h3_header_list *l = (h3_header_list *)argp;
+	if (l->len == l->cap) {
+		size_t cap = l->cap == 0 ? 8 : l->cap * 2;
+		quiche_h3_header *h = realloc(l->headers, cap * sizeof(quiche_h3_header));
+		if (h == NULL) {
+			return -1;
+		}
+		l->headers = h;
+		l->cap = cap;
+	}
+	quiche_h3_header *h = &l->headers[l->len++];
+	h->name = name;
+	h->name_len = name_len;
+	h->value = value;
+	h->value_len = value_len;
+	return 0;
+}
+
+// h3_event_headers collects headers of the event. Returned names and values
+// refer to the event and the list must be freed.
+static inline h3_header_list h3_event_headers(quiche_h3_event *ev) {
+	h3_header_list l;
+	memset(&l, 0, sizeof(l));
+	quiche_h3_event_for_each_header(ev, h3_collect_header, &l);
+	return l;
+}
+
+typedef struct {
+	int stream_id;
+	quiche_h3_event *ev;
+} h3_poll_result;
+
+static inline h3_poll_result h3_conn_poll(quiche_h3_conn *conn, quiche_conn *quic_conn) {
+	h3_poll_result r;
+	r.ev = NULL;
+	r.stream_id = quiche_h3_conn_poll(conn, quic_conn, &r.ev);
+	return r;
+}
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// H3ApplicationProtocol is the current HTTP/3 ALPN token in wire format,
+// which can be used in Config.SetApplicationProtos.
+const H3ApplicationProtocol = "\x05h3-20"
+
+// H3Error is an HTTP/3 error. Codes are those returned by quiche HTTP/3
+// functions, which quiche.h does not declare.
+type H3Error int
+
+const (
+	H3ErrInternal             = H3Error(-3)  // Internal error in the HTTP/3 stack.
+	H3ErrExcessiveLoad        = H3Error(-4)  // The endpoint detected that its peer is causing excessive load.
+	H3ErrID                   = H3Error(-5)  // Stream ID or push ID greater than current maximum was used.
+	H3ErrStreamCreation       = H3Error(-6)  // The endpoint detected that its peer created a stream that it will not accept.
+	H3ErrClosedCriticalStream = H3Error(-7)  // A required critical stream was closed.
+	H3ErrMissingSettings      = H3Error(-8)  // No SETTINGS frame at beginning of control stream.
+	H3ErrFrameUnexpected      = H3Error(-9)  // A frame was received which is not permitted in the current state.
+	H3ErrFrame                = H3Error(-10) // Frame violated layout or size rules.
+	H3ErrQPACKDecompression   = H3Error(-11) // QPACK header block decompression failure.
+	H3ErrTransport            = H3Error(-12) // An error from the QUIC transport, e.g. the stream limit was reached.
+	H3ErrStreamBlocked        = H3Error(-13) // The stream is blocked by flow control.
+)
+
+var h3ErrorDescriptions = map[H3Error]string{
+	H3ErrInternal:             "HTTP/3 internal error",
+	H3ErrExcessiveLoad:        "HTTP/3 excessive load",
+	H3ErrID:                   "HTTP/3 ID is invalid",
+	H3ErrStreamCreation:       "HTTP/3 stream creation failed",
+	H3ErrClosedCriticalStream: "HTTP/3 critical stream was closed",
+	H3ErrMissingSettings:      "HTTP/3 settings are missing",
+	H3ErrFrameUnexpected:      "HTTP/3 frame is unexpected",
+	H3ErrFrame:                "HTTP/3 frame is invalid",
+	H3ErrQPACKDecompression:   "QPACK decompression failed",
+	H3ErrTransport:            "HTTP/3 transport error",
+	H3ErrStreamBlocked:        "HTTP/3 stream is blocked",
+}
+
+func (e H3Error) Error() string {
+	if desc, ok := h3ErrorDescriptions[e]; ok {
+		return desc
+	}
+	return fmt.Sprintf("unknown HTTP/3 error (%d)", int(e))
+}
+
+// Temporary returns true if the operation can be retried later.
+func (e H3Error) Temporary() bool {
+	return e == H3ErrStreamBlocked
+}
+
+// Fatal returns true if the HTTP/3 connection can not be used anymore.
+// The cause of H3ErrTransport is not known so it is not considered fatal,
+// the QUIC connection tells whether it has been closed.
+func (e H3Error) Fatal() bool {
+	switch e {
+	case H3ErrTransport, H3ErrStreamBlocked:
+		return false
+	default:
+		return true
+	}
+}
+
+// toH3Error converts a negative error code returned by quiche HTTP/3
+// functions to an error. Codes shared with the transport are returned as
+// Error so that ErrDone can still be compared with ==.
+func toH3Error(n int) error {
+	if n == int(ErrDone) || n == int(ErrBufferTooShort) {
+		return toError(n)
+	}
+	return H3Error(n)
+}
+
+// H3Config stores HTTP/3 configuration shared between multiple connections.
+type H3Config C.quiche_h3_config
+
+// NewH3Config creates a HTTP/3 config object with the given settings.
+func NewH3Config(numPlaceholders, maxHeaderListSize, qpackMaxTableCapacity, qpackBlockedStreams uint64) *H3Config {
+	c := C.quiche_h3_config_new(C.uint64_t(numPlaceholders),
+		C.uint64_t(maxHeaderListSize),
+		C.uint64_t(qpackMaxTableCapacity),
+		C.uint64_t(qpackBlockedStreams))
+	if c == nil {
+		panic("could not create HTTP/3 config")
+	}
+	return (*H3Config)(c)
+}
+
+// Free frees the HTTP/3 config object.
+func (c *H3Config) Free() {
+	C.quiche_h3_config_free((*C.quiche_h3_config)(c))
+}
+
+// H3Connection is a HTTP/3 connection.
+type H3Connection C.quiche_h3_conn
+
+// H3Accept creates a new server-side HTTP/3 connection using the provided QUIC connection.
+// It returns nil if the connection could not be created.
+func H3Accept(conn *Connection, config *H3Config) *H3Connection {
+	c := C.quiche_h3_accept((*C.quiche_conn)(conn), (*C.quiche_h3_config)(config))
+	return (*H3Connection)(c)
+}
+
+// H3Connect creates a new client-side HTTP/3 connection using the provided QUIC connection.
+// It returns nil if the connection could not be created.
+func H3Connect(conn *Connection, config *H3Config) *H3Connection {
+	c := C.quiche_h3_conn_new_with_transport((*C.quiche_conn)(conn), (*C.quiche_h3_config)(config))
+	return (*H3Connection)(c)
+}
+
+// H3Header is a HTTP/3 header.
+type H3Header struct {
+	Name  []byte
+	Value []byte
+}
+
+// H3EventType is type of a HTTP/3 event.
+type H3EventType int
+
+const (
+	H3EventHeaders  = H3EventType(C.QUICHE_H3_EVENT_HEADERS)  // Request/response headers were received.
+	H3EventData     = H3EventType(C.QUICHE_H3_EVENT_DATA)     // Data was received.
+	H3EventFinished = H3EventType(C.QUICHE_H3_EVENT_FINISHED) // Stream was closed.
+)
+
+// H3Event is a HTTP/3 event returned by H3Connection.Poll.
+type H3Event C.quiche_h3_event
+
+// Type returns the type of the event.
+func (e *H3Event) Type() H3EventType {
+	return H3EventType(C.quiche_h3_event_type((*C.quiche_h3_event)(e)))
+}
+
+// Headers returns a copy of headers in the event.
+func (e *H3Event) Headers() []H3Header {
+	l := C.h3_event_headers((*C.quiche_h3_event)(e))
+	if l.headers == nil {
+		return nil
+	}
+	defer C.free(unsafe.Pointer(l.headers))
+	hs := (*[1 << 20]C.quiche_h3_header)(unsafe.Pointer(l.headers))[:l.len:l.len]
+	headers := make([]H3Header, len(hs))
+	for i, h := range hs {
+		headers[i].Name = C.GoBytes(unsafe.Pointer(h.name), C.int(h.name_len))
+		headers[i].Value = C.GoBytes(unsafe.Pointer(h.value), C.int(h.value_len))
+	}
+	return headers
+}
+
+// Free frees the HTTP/3 event object.
+func (e *H3Event) Free() {
+	C.quiche_h3_event_free((*C.quiche_h3_event)(e))
+}
+
+// Poll processes HTTP/3 data received from the peer. It returns ErrDone when
+// there is no event. The returned event must be freed.
+func (c *H3Connection) Poll(conn *Connection) (uint64, *H3Event, error) {
+	r := C.h3_conn_poll((*C.quiche_h3_conn)(c), (*C.quiche_conn)(conn))
+	if r.stream_id < 0 {
+		return 0, nil, toH3Error(int(r.stream_id))
+	}
+	return uint64(r.stream_id), (*H3Event)(r.ev), nil
+}
+
+// SendRequest sends a HTTP/3 request and returns its stream ID. Errors other
+// than ErrDone are wrapped in OpError with operation OpH3SendRequest.
+func (c *H3Connection) SendRequest(conn *Connection, headers []H3Header, fin bool) (uint64, error) {
+	hs, n := newCH3Headers(headers)
+	defer C.free(unsafe.Pointer(hs))
+	id := C.quiche_h3_send_request((*C.quiche_h3_conn)(c), (*C.quiche_conn)(conn),
+		hs, n, C.bool(fin))
+	if id < 0 {
+		return 0, wrapError(toH3Error(int(id)), OpH3SendRequest, 0)
+	}
+	return uint64(id), nil
+}
+
+// SendResponse sends a HTTP/3 response on the specified stream. Errors other
+// than ErrDone are wrapped in OpError as those of Connection.StreamSend.
+func (c *H3Connection) SendResponse(conn *Connection, streamID uint64, headers []H3Header, fin bool) error {
+	hs, n := newCH3Headers(headers)
+	defer C.free(unsafe.Pointer(hs))
+	err := C.quiche_h3_send_response((*C.quiche_h3_conn)(c), (*C.quiche_conn)(conn),
+		C.uint64_t(streamID), hs, n, C.bool(fin))
+	if err < 0 {
+		return wrapError(toH3Error(int(err)), OpStreamSend, streamID)
+	}
+	return nil
+}
+
+// SendBody sends a HTTP/3 body chunk on the given stream. Errors other than
+// ErrDone are wrapped in OpError as those of Connection.StreamSend.
+func (c *H3Connection) SendBody(conn *Connection, streamID uint64, b []byte, fin bool) (int, error) {
+	n := C.quiche_h3_send_body((*C.quiche_h3_conn)(c), (*C.quiche_conn)(conn),
+		C.uint64_t(streamID), cbytes(b), clen(b), C.bool(fin))
+	if n < 0 {
+		return 0, wrapError(toH3Error(int(n)), OpStreamSend, streamID)
+	}
+	return int(n), nil
+}
+
+// RecvBody reads request or response body data into the provided buffer.
+// Errors other than ErrDone are wrapped in OpError as those of Connection.StreamRecv.
+func (c *H3Connection) RecvBody(conn *Connection, streamID uint64, b []byte) (int, error) {
+	n := C.quiche_h3_recv_body((*C.quiche_h3_conn)(c), (*C.quiche_conn)(conn),
+		C.uint64_t(streamID), cbytes(b), clen(b))
+	if n < 0 {
+		return 0, wrapError(toH3Error(int(n)), OpStreamRecv, streamID)
+	}
+	return int(n), nil
+}
+
+// Free frees the HTTP/3 connection object.
+func (c *H3Connection) Free() {
+	C.quiche_h3_conn_free((*C.quiche_h3_conn)(c))
+}
+
+// newCH3Headers copies headers to C memory, as C memory must not contain Go pointers.
+// The returned pointer must be freed.
+func newCH3Headers(headers []H3Header) (*C.quiche_h3_header, C.size_t) {
+	size := len(headers) * int(unsafe.Sizeof(C.quiche_h3_header{}))
+	for _, h := range headers {
+		size += len(h.Name) + len(h.Value)
+	}
+	if size == 0 {
+		size = 1
+	}
+	p := C.malloc(C.size_t(size))
+	if p == nil {
+		panic("could not allocate HTTP/3 headers")
+	}
+	hs := (*[1 << 20]C.quiche_h3_header)(p)[:len(headers):len(headers)]
+	data := (*[1 << 30]byte)(p)[:size:size]
+	off := len(headers) * int(unsafe.Sizeof(C.quiche_h3_header{}))
+	for i, h := range headers {
+		hs[i].name = (*C.uint8_t)(unsafe.Pointer(uintptr(p) + uintptr(off)))
+		hs[i].name_len = C.size_t(copy(data[off:], h.Name))
+		off += len(h.Name)
+		hs[i].value = (*C.uint8_t)(unsafe.Pointer(uintptr(p) + uintptr(off)))
+		hs[i].value_len = C.size_t(copy(data[off:], h.Value))
+		off += len(h.Value)
+	}
+	return (*C.quiche_h3_header)(p), C.size_t(len(headers))
+}
@@ -0,0 +1,132 @@
+// Package certutil generates self-signed certificates for the command line
+// tool and tests.
+package certutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Cert is a PEM encoded certificate and its private key.
+type Cert struct {
+	Cert []byte
+	Key  []byte
+	// Fingerprint is SHA-256 of the DER encoded certificate.
+	Fingerprint [sha256.Size]byte
+}
+
+// Generate creates an ECDSA P-256 self-signed certificate for the
+// comma-separated host names and IP addresses.
+func Generate(hosts string, validFor time.Duration) (*Cert, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"quiche-go"}},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range strings.Split(hosts, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	if len(template.IPAddresses) == 0 && len(template.DNSNames) == 0 {
+		return nil, errors.New("no host names or IP addresses given")
+	}
+	if len(template.DNSNames) > 0 {
+		template.Subject.CommonName = template.DNSNames[0]
+	} else {
+		template.Subject.CommonName = template.IPAddresses[0].String()
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Cert{
+		Cert:        pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:         pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		Fingerprint: sha256.Sum256(der),
+	}, nil
+}
+
+// FingerprintString returns the fingerprint as colon-separated hex bytes.
+func (c *Cert) FingerprintString() string {
+	var b strings.Builder
+	for i, v := range c.Fingerprint {
+		if i > 0 {
+			b.WriteByte(':')
+		}
+		fmt.Fprintf(&b, "%02X", v)
+	}
+	return b.String()
+}
+
+// WriteFiles writes the certificate and key files. The key is only readable
+// by the owner. Unless force is true, it fails without writing anything if
+// either file exists.
+func (c *Cert) WriteFiles(certFile, keyFile string, force bool) error {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		// Checked first so that the certificate is not left alone.
+		_, err := os.Lstat(keyFile)
+		if err == nil {
+			return &os.PathError{Op: "open", Path: keyFile, Err: os.ErrExist}
+		}
+	}
+	err := writeFile(certFile, c.Cert, flag, 0644)
+	if err != nil {
+		return err
+	}
+	err = writeFile(keyFile, c.Key, flag, 0600)
+	if err != nil && !force {
+		os.Remove(certFile)
+	}
+	return err
+}
+
+func writeFile(name string, data []byte, flag int, perm os.FileMode) error {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
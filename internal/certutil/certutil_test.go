@@ -0,0 +1,96 @@
+package certutil
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGenerate(t *testing.T) {
+	c, err := Generate("localhost, 127.0.0.1,::1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(c.Cert)
+	if block == nil {
+		t.Fatalf("invalid certificate: %s", c.Cert)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "localhost" || len(cert.DNSNames) != 1 || len(cert.IPAddresses) != 2 {
+		t.Fatalf("unexpected names: %v %v %v", cert.Subject.CommonName, cert.DNSNames, cert.IPAddresses)
+	}
+	if err = cert.VerifyHostname("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Generate(" ,", time.Hour)
+	if err == nil {
+		t.Fatal("expect error for empty hosts")
+	}
+}
+
+func TestWriteFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.crt")
+	keyFile := filepath.Join(dir, "cert.key")
+	c1, err := Generate("localhost", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := Generate("localhost", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c1.WriteFiles(certFile, keyFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		t.Fatalf("key file must only be readable by the owner: %v", fi.Mode())
+	}
+	// Existing files are not overwritten.
+	err = c2.WriteFiles(certFile, keyFile, false)
+	if !os.IsExist(err) {
+		t.Fatalf("expect error for existing files: %v", err)
+	}
+	err = c2.WriteFiles(filepath.Join(dir, "new.crt"), keyFile, false)
+	if !os.IsExist(err) {
+		t.Fatalf("expect error for existing key file: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "new.crt")); !os.IsNotExist(err) {
+		t.Fatalf("certificate must not be written: %v", err)
+	}
+	checkFile(t, certFile, c1.Cert)
+	checkFile(t, keyFile, c1.Key)
+	err = c2.WriteFiles(certFile, keyFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, certFile, c2.Cert)
+	checkFile(t, keyFile, c2.Key)
+}
+
+func checkFile(t *testing.T, name string, data []byte) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("unexpected content of %s", name)
+	}
+}
@@ -0,0 +1,95 @@
+//go:build linux && cgo
+// +build linux,cgo
+
+package netsim
+
+/*
+#include <stdint.h>
+#include <time.h>
+#include <unistd.h>
+#include <sys/syscall.h>
+
+// frozen is the monotonic time in nanoseconds while the clock is held,
+// otherwise zero. offset is added to the real time when it is not held.
+static int64_t netsim_frozen;
+static int64_t netsim_offset;
+
+static int64_t netsim_real_now() {
+	struct timespec ts;
+	syscall(SYS_clock_gettime, CLOCK_MONOTONIC, &ts);
+	return (int64_t)ts.tv_sec * 1000000000 + ts.tv_nsec;
+}
+
+// clock_gettime replaces the C library function for code linked into the
+// program, including the QUIC library, so that its monotonic clock follows
+// the network. The Go runtime does not call it.
+int clock_gettime(clockid_t id, struct timespec *ts) {
+	if (id != CLOCK_MONOTONIC) {
+		return syscall(SYS_clock_gettime, id, ts);
+	}
+	int64_t ns = __atomic_load_n(&netsim_frozen, __ATOMIC_SEQ_CST);
+	if (ns == 0) {
+		ns = netsim_real_now() + __atomic_load_n(&netsim_offset, __ATOMIC_SEQ_CST);
+	}
+	ts->tv_sec = ns / 1000000000;
+	ts->tv_nsec = ns % 1000000000;
+	return 0;
+}
+
+static void netsim_freeze() {
+	int64_t ns = netsim_real_now() + __atomic_load_n(&netsim_offset, __ATOMIC_SEQ_CST);
+	__atomic_store_n(&netsim_frozen, ns, __ATOMIC_SEQ_CST);
+}
+
+static void netsim_advance(int64_t d) {
+	__atomic_add_fetch(&netsim_frozen, d, __ATOMIC_SEQ_CST);
+}
+
+// netsim_release continues from the frozen time so the clock never goes back.
+static void netsim_release() {
+	int64_t ns = __atomic_load_n(&netsim_frozen, __ATOMIC_SEQ_CST);
+	__atomic_store_n(&netsim_offset, ns - netsim_real_now(), __ATOMIC_SEQ_CST);
+	__atomic_store_n(&netsim_frozen, 0, __ATOMIC_SEQ_CST);
+}
+
+static int64_t netsim_now() {
+	struct timespec ts;
+	clock_gettime(CLOCK_MONOTONIC, &ts);
+	return (int64_t)ts.tv_sec * 1000000000 + ts.tv_nsec;
+}
+*/
+import "C"
+import "time"
+
+// VirtualClock is whether endpoints see the simulated time. Otherwise the
+// network sleeps until their timers expire.
+const VirtualClock = true
+
+// clockHolds is the number of nested holds of the clock.
+var clockHolds int
+
+// holdClock stops the monotonic clock of the QUIC library from following the
+// real time, so that it only advances with the network.
+func holdClock() {
+	if clockHolds == 0 {
+		C.netsim_freeze()
+	}
+	clockHolds++
+}
+
+func releaseClock() {
+	clockHolds--
+	if clockHolds == 0 {
+		C.netsim_release()
+	}
+}
+
+// advanceClock moves the held clock forward by d.
+func advanceClock(d time.Duration) {
+	C.netsim_advance(C.int64_t(d))
+}
+
+// libraryNow returns the monotonic time seen by C code.
+func libraryNow() time.Duration {
+	return time.Duration(C.netsim_now())
+}
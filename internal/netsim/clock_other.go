@@ -0,0 +1,23 @@
+//go:build !linux || !cgo
+// +build !linux !cgo
+
+package netsim
+
+import "time"
+
+// VirtualClock is whether endpoints see the simulated time. Otherwise the
+// network sleeps until their timers expire.
+const VirtualClock = false
+
+func holdClock() {}
+
+func releaseClock() {}
+
+// advanceClock waits for d as endpoints measure time with the real clock.
+func advanceClock(d time.Duration) {
+	time.Sleep(d)
+}
+
+func libraryNow() time.Duration {
+	return time.Duration(time.Now().UnixNano())
+}
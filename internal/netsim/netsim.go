@@ -0,0 +1,302 @@
+// Package netsim is a test network which forwards datagrams between QUIC
+// endpoints in memory with seeded loss, duplication, reordering and delay.
+//
+// Events are processed on a virtual clock: while the network runs, the
+// monotonic clock of the QUIC library, which measures RTT and drives loss
+// recovery and idle timers, only advances with the scheduled time of events.
+// Therefore latency, jitter and bandwidth are seen by the endpoints without
+// waiting for them, and runs with the same seed process the same events.
+// The clock is replaced by overriding clock_gettime in the test program, which
+// is only supported on Linux with cgo. Elsewhere VirtualClock is false and
+// the network sleeps until endpoint timers expire instead.
+//
+// The clock is global so networks must not run concurrently.
+package netsim
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Endpoint is a connection attached to the network. *quiche.Connection
+// implements it.
+type Endpoint interface {
+	Recv(b []byte) (int, error)
+	Send(b []byte) (int, error)
+	Timeout() time.Duration
+	OnTimeout()
+	IsClosed() bool
+}
+
+// LinkConfig configures conditions of datagrams sent in one direction.
+type LinkConfig struct {
+	Latency time.Duration // One-way delay.
+	Jitter  time.Duration // Maximum random delay added to Latency.
+	// Probabilities in range [0, 1].
+	Loss      float64 // A datagram is dropped.
+	Duplicate float64 // A datagram is delivered twice.
+	Reorder   float64 // A datagram is delayed by ReorderDelay.
+	// ReorderDelay defaults to Latency, or a millisecond if both are zero.
+	ReorderDelay time.Duration
+	// Bandwidth in bytes per second. Zero is unlimited.
+	Bandwidth int
+	// MTU is the maximum datagram size. Larger datagrams are dropped.
+	// Zero is unlimited.
+	MTU int
+}
+
+// LinkStats counts datagrams sent over a link.
+type LinkStats struct {
+	Sent       int
+	Delivered  int
+	Lost       int
+	Duplicated int
+	Reordered  int
+	Oversized  int
+}
+
+type link struct {
+	config LinkConfig
+	stats  LinkStats
+	// busy is when the link finishes transmitting queued datagrams.
+	busy time.Duration
+}
+
+type node struct {
+	endpoint Endpoint
+	peer     int
+	out      *link
+}
+
+type datagram struct {
+	// at is the scheduled delivery time.
+	at  time.Duration
+	seq uint64
+	to  int
+	b   []byte
+}
+
+type datagramQueue []*datagram
+
+func (q datagramQueue) Len() int { return len(q) }
+func (q datagramQueue) Less(i, j int) bool {
+	if q[i].at == q[j].at {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at < q[j].at
+}
+func (q datagramQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *datagramQueue) Push(x interface{}) { *q = append(*q, x.(*datagram)) }
+func (q *datagramQueue) Pop() interface{} {
+	old := *q
+	d := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return d
+}
+
+// ErrNoEvents is returned by Run when no datagram is in flight and no
+// endpoint has a timer.
+var ErrNoEvents = errors.New("netsim: no more events")
+
+// ErrTimeLimit is returned by Run when the scheduled time limit is reached.
+var ErrTimeLimit = errors.New("netsim: time limit reached")
+
+// Network connects pairs of endpoints with simulated links.
+type Network struct {
+	// now is the scheduled time of the last event since the network was created.
+	now  time.Duration
+	rand *rand.Rand
+	// done is the error returned by endpoints when there is no more work.
+	done  error
+	nodes []*node
+	queue datagramQueue
+	seq   uint64
+	buf   []byte
+}
+
+// New creates a network whose random decisions are seeded by seed. done is
+// the error endpoints return when there is nothing to send or receive,
+// i.e. quiche.ErrDone.
+func New(seed int64, done error) *Network {
+	return &Network{
+		rand: rand.New(rand.NewSource(seed)),
+		done: done,
+		buf:  make([]byte, 65535),
+	}
+}
+
+// Now returns the scheduled time of the last processed event since the
+// network was created.
+func (n *Network) Now() time.Duration {
+	return n.now
+}
+
+// advance moves the scheduled time, and the clock of endpoints with it.
+func (n *Network) advance(to time.Duration) {
+	if to > n.now {
+		advanceClock(to - n.now)
+		n.now = to
+	}
+}
+
+// Connect attaches a pair of endpoints and returns their node IDs.
+// Datagrams from a to b are subject to ab, and from b to a to ba.
+func (n *Network) Connect(a, b Endpoint, ab, ba LinkConfig) (int, int) {
+	i := len(n.nodes)
+	n.nodes = append(n.nodes,
+		&node{endpoint: a, peer: i + 1, out: &link{config: ab}},
+		&node{endpoint: b, peer: i, out: &link{config: ba}})
+	return i, i + 1
+}
+
+// LinkStats returns statistics of datagrams sent by the node.
+func (n *Network) LinkStats(from int) LinkStats {
+	return n.nodes[from].out.stats
+}
+
+// Flush sends all datagrams the endpoints have to send.
+func (n *Network) Flush() error {
+	for i, nd := range n.nodes {
+		for !nd.endpoint.IsClosed() {
+			size, err := nd.endpoint.Send(n.buf)
+			if err == n.done {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("node %d send: %v", i, err)
+			}
+			n.transmit(nd, n.buf[:size])
+		}
+	}
+	return nil
+}
+
+// transmit schedules delivery of the datagram b sent by nd.
+func (n *Network) transmit(nd *node, b []byte) {
+	l := nd.out
+	c := &l.config
+	l.stats.Sent++
+	if c.MTU > 0 && len(b) > c.MTU {
+		l.stats.Oversized++
+		return
+	}
+	// Queued datagrams are transmitted one after another.
+	if l.busy < n.now {
+		l.busy = n.now
+	}
+	if c.Bandwidth > 0 {
+		l.busy += time.Duration(len(b)) * time.Second / time.Duration(c.Bandwidth)
+	}
+	// Always draw the same numbers so that one condition does not change
+	// the fate of following datagrams.
+	lost := n.rand.Float64() < c.Loss
+	dup := n.rand.Float64() < c.Duplicate
+	reorder := n.rand.Float64() < c.Reorder
+	var jitter time.Duration
+	if c.Jitter > 0 {
+		jitter = time.Duration(n.rand.Int63n(int64(c.Jitter)))
+	}
+	if lost {
+		l.stats.Lost++
+		return
+	}
+	at := l.busy + c.Latency + jitter
+	if reorder {
+		l.stats.Reordered++
+		d := c.ReorderDelay
+		if d == 0 {
+			d = c.Latency
+		}
+		if d == 0 {
+			d = time.Millisecond
+		}
+		at += d
+	}
+	n.schedule(at, nd.peer, b)
+	if dup {
+		l.stats.Duplicated++
+		n.schedule(at, nd.peer, b)
+	}
+}
+
+func (n *Network) schedule(at time.Duration, to int, b []byte) {
+	n.seq++
+	heap.Push(&n.queue, &datagram{
+		at:  at,
+		seq: n.seq,
+		to:  to,
+		b:   append([]byte(nil), b...),
+	})
+}
+
+// Step sends pending datagrams and then processes the next event, which is
+// either delivery of a datagram or expiry of an endpoint timer. It returns
+// false if there are no events.
+func (n *Network) Step() (bool, error) {
+	holdClock()
+	defer releaseClock()
+	err := n.Flush()
+	if err != nil {
+		return false, err
+	}
+	timer := -1
+	var timerAt time.Duration
+	for i, nd := range n.nodes {
+		if nd.endpoint.IsClosed() {
+			continue
+		}
+		// Negative timeout means there is no timer.
+		d := nd.endpoint.Timeout()
+		if d < 0 {
+			continue
+		}
+		if at := n.now + d; timer < 0 || at < timerAt {
+			timer, timerAt = i, at
+		}
+	}
+	if len(n.queue) > 0 && (timer < 0 || n.queue[0].at <= timerAt) {
+		d := heap.Pop(&n.queue).(*datagram)
+		n.advance(d.at)
+		nd := n.nodes[d.to]
+		if nd.endpoint.IsClosed() {
+			return true, nil
+		}
+		n.nodes[nd.peer].out.stats.Delivered++
+		_, err = nd.endpoint.Recv(d.b)
+		if err != nil && err != n.done {
+			return true, fmt.Errorf("node %d recv: %v", d.to, err)
+		}
+		return true, nil
+	}
+	if timer < 0 {
+		return false, nil
+	}
+	n.advance(timerAt)
+	n.nodes[timer].endpoint.OnTimeout()
+	return true, nil
+}
+
+// Run processes events until done returns true or the scheduled time has
+// advanced by limit.
+func (n *Network) Run(done func() bool, limit time.Duration) error {
+	holdClock()
+	defer releaseClock()
+	deadline := n.now + limit
+	for !done() {
+		if n.now > deadline {
+			return ErrTimeLimit
+		}
+		ok, err := n.Step()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrNoEvents
+		}
+	}
+	// Send what the last event produced, e.g. acknowledgements.
+	return n.Flush()
+}
@@ -0,0 +1,200 @@
+package netsim
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var errDone = errors.New("done")
+
+// testEndpoint sends numbered datagrams of a fixed size and records what it
+// receives with the scheduled time.
+type testEndpoint struct {
+	net      *Network
+	toSend   int
+	size     int
+	sent     int
+	received []byte
+	times    []time.Duration
+	timeout  time.Duration
+	timeouts []time.Duration
+}
+
+func (e *testEndpoint) Send(b []byte) (int, error) {
+	if e.sent >= e.toSend {
+		return 0, errDone
+	}
+	for i := range b[:e.size] {
+		b[i] = byte(e.sent)
+	}
+	e.sent++
+	return e.size, nil
+}
+
+func (e *testEndpoint) Recv(b []byte) (int, error) {
+	e.received = append(e.received, b[0])
+	e.times = append(e.times, e.net.Now())
+	return len(b), nil
+}
+
+func (e *testEndpoint) Timeout() time.Duration {
+	return e.timeout
+}
+
+func (e *testEndpoint) OnTimeout() {
+	e.timeouts = append(e.timeouts, e.net.Now())
+	e.timeout = -1
+}
+
+func (e *testEndpoint) IsClosed() bool {
+	return false
+}
+
+func newTestPair(n *Network, toSend, size int, ab LinkConfig) (*testEndpoint, *testEndpoint) {
+	a := &testEndpoint{net: n, toSend: toSend, size: size, timeout: -1}
+	b := &testEndpoint{net: n, timeout: -1}
+	n.Connect(a, b, ab, LinkConfig{})
+	return a, b
+}
+
+func runAll(t *testing.T, n *Network) {
+	for {
+		ok, err := n.Step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+func TestLatencyAndBandwidth(t *testing.T) {
+	n := New(1, errDone)
+	// 1000 bytes take 10ms at 100KB/s.
+	_, b := newTestPair(n, 3, 1000, LinkConfig{Latency: 20 * time.Millisecond, Bandwidth: 100000})
+	runAll(t, n)
+	if string(b.received) != "\x00\x01\x02" {
+		t.Fatalf("unexpected datagrams: %x", b.received)
+	}
+	for i, at := range b.times {
+		want := time.Duration(i+1)*10*time.Millisecond + 20*time.Millisecond
+		if at != want {
+			t.Fatalf("unexpected arrival of datagram %d: want %v, actual %v", i, want, at)
+		}
+	}
+}
+
+func TestLossAndDuplication(t *testing.T) {
+	n := New(1, errDone)
+	_, b := newTestPair(n, 1000, 10, LinkConfig{Loss: 0.2, Duplicate: 0.1, MTU: 20})
+	runAll(t, n)
+	s := n.LinkStats(0)
+	if s.Sent != 1000 || s.Lost == 0 || s.Duplicated == 0 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+	if s.Delivered != s.Sent-s.Lost+s.Duplicated || len(b.received) != s.Delivered {
+		t.Fatalf("unexpected deliveries: %+v, received %d", s, len(b.received))
+	}
+	if s.Lost < 150 || s.Lost > 250 {
+		t.Fatalf("unexpected loss rate: %+v", s)
+	}
+
+	n = New(1, errDone)
+	_, b = newTestPair(n, 10, 100, LinkConfig{MTU: 99})
+	runAll(t, n)
+	if len(b.received) != 0 || n.LinkStats(0).Oversized != 10 {
+		t.Fatalf("oversized datagrams must be dropped: %+v", n.LinkStats(0))
+	}
+}
+
+func TestReorder(t *testing.T) {
+	n := New(1, errDone)
+	_, b := newTestPair(n, 100, 10, LinkConfig{
+		Latency:      time.Millisecond,
+		Bandwidth:    10000,
+		Reorder:      0.3,
+		ReorderDelay: 5 * time.Millisecond,
+	})
+	runAll(t, n)
+	if n.LinkStats(0).Reordered == 0 || len(b.received) != 100 {
+		t.Fatalf("unexpected stats: %+v", n.LinkStats(0))
+	}
+	inversions := 0
+	for i := 1; i < len(b.received); i++ {
+		if b.received[i] < b.received[i-1] {
+			inversions++
+		}
+	}
+	if inversions == 0 {
+		t.Fatalf("datagrams are not reordered: %x", b.received)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	config := LinkConfig{
+		Latency:   5 * time.Millisecond,
+		Jitter:    5 * time.Millisecond,
+		Loss:      0.1,
+		Duplicate: 0.05,
+		Reorder:   0.1,
+	}
+	var results [2][]byte
+	for i := range results {
+		n := New(42, errDone)
+		_, b := newTestPair(n, 200, 10, config)
+		runAll(t, n)
+		results[i] = b.received
+	}
+	if string(results[0]) != string(results[1]) {
+		t.Fatalf("runs with the same seed differ:\n%x\n%x", results[0], results[1])
+	}
+}
+
+func TestTimer(t *testing.T) {
+	n := New(1, errDone)
+	a, b := newTestPair(n, 1, 10, LinkConfig{Latency: 50 * time.Millisecond})
+	a.timeout = 30 * time.Millisecond
+	b.timeout = 100 * time.Millisecond
+	start := time.Now()
+	err := n.Run(func() bool { return len(b.timeouts) > 0 }, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a's timer fires before the datagram is delivered, then b's timer,
+	// which is relative to the delivery.
+	if len(a.timeouts) != 1 || a.timeouts[0] != 30*time.Millisecond ||
+		len(b.times) != 1 || b.times[0] != 50*time.Millisecond ||
+		b.timeouts[0] != 150*time.Millisecond {
+		t.Fatalf("unexpected events: timeouts %v %v, received %v", a.timeouts, b.timeouts, b.times)
+	}
+	if VirtualClock && time.Since(start) >= 100*time.Millisecond {
+		t.Fatalf("network must not wait for timers: %v", time.Since(start))
+	}
+	err = n.Run(func() bool { return false }, time.Second)
+	if err != ErrNoEvents {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestVirtualClock(t *testing.T) {
+	if !VirtualClock {
+		t.Skip("virtual clock is not supported")
+	}
+	holdClock()
+	start := libraryNow()
+	time.Sleep(10 * time.Millisecond)
+	if d := libraryNow() - start; d != 0 {
+		t.Fatalf("held clock must not advance: %v", d)
+	}
+	advanceClock(time.Hour)
+	if d := libraryNow() - start; d != time.Hour {
+		t.Fatalf("unexpected advance: want %v, actual %v", time.Hour, d)
+	}
+	releaseClock()
+	// The clock continues from the simulated time.
+	if d := libraryNow() - start; d < time.Hour || d > time.Hour+time.Second {
+		t.Fatalf("unexpected time after release: %v", d)
+	}
+}
@@ -0,0 +1,93 @@
+package quiche
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// KeyLogEnv is the environment variable naming the file which TLS secrets are
+// appended to when key logging is enabled.
+const KeyLogEnv = "SSLKEYLOGFILE"
+
+// keyLog copies secrets written to a pipe by the TLS library to the writer.
+type keyLog struct {
+	mu sync.Mutex
+	w  io.Writer
+	// pw is kept open so that the library can open its path at any time.
+	pw *os.File
+}
+
+var keyLogger keyLog
+
+func (k *keyLog) setWriter(w io.Writer) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.w = w
+	if k.pw != nil {
+		return nil
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	err = setCEnv(KeyLogEnv, fmt.Sprintf("/dev/fd/%d", pw.Fd()))
+	if err != nil {
+		pr.Close()
+		pw.Close()
+		return err
+	}
+	k.pw = pw
+	go k.copy(pr)
+	return nil
+}
+
+func (k *keyLog) copy(r io.Reader) {
+	b := make([]byte, 4096)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			k.mu.Lock()
+			k.w.Write(b[:n])
+			k.mu.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// setCEnv sets the variable in the C environment, which the TLS library reads
+// the key log file name from, without changing the environment seen by
+// os.Getenv and inherited by commands started with os/exec.
+func setCEnv(name, value string) error {
+	cn := C.CString(name)
+	cv := C.CString(value)
+	rc := C.setenv(cn, cv, 1)
+	C.free(unsafe.Pointer(cn))
+	C.free(unsafe.Pointer(cv))
+	if rc != 0 {
+		return fmt.Errorf("could not set %s", name)
+	}
+	return nil
+}
+
+// LogKeysTo enables logging of TLS secrets in NSS key log format to w.
+// The TLS library only writes secrets to the file named by SSLKEYLOGFILE, so
+// the variable is set in the C environment to a pipe copied to w. Therefore
+// w receives secrets of all configs which have key logging enabled, and it
+// replaces the writer given in previous calls.
+func (c *Config) LogKeysTo(w io.Writer) error {
+	err := keyLogger.setWriter(w)
+	if err != nil {
+		return err
+	}
+	c.LogKeys()
+	return nil
+}
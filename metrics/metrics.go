@@ -0,0 +1,362 @@
+// Package metrics collects metrics of QUIC listeners and connections and
+// exports them in Prometheus text format and through expvar.
+package metrics
+
+import (
+	"bytes"
+	"expvar"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Value returns the current value.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// Gauge is a value which can go up and down.
+type Gauge struct {
+	v int64
+}
+
+// Inc increments the gauge by one.
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+// Dec decrements the gauge by one.
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+// Value returns the current value.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+// CounterVec is a set of counters partitioned by the value of a label.
+type CounterVec struct {
+	label    string
+	mu       sync.Mutex
+	counters map[string]*Counter
+}
+
+// NewCounterVec creates a counter set with the label name.
+func NewCounterVec(label string) *CounterVec {
+	return &CounterVec{
+		label:    label,
+		counters: make(map[string]*Counter),
+	}
+}
+
+// With returns the counter for the label value.
+func (v *CounterVec) With(value string) *Counter {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.counters[value]
+	if !ok {
+		c = &Counter{}
+		v.counters[value] = c
+	}
+	return c
+}
+
+// Values returns the current value of each counter by label value.
+func (v *CounterVec) Values() map[string]uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m := make(map[string]uint64, len(v.counters))
+	for k, c := range v.counters {
+		m[k] = c.Value()
+	}
+	return m
+}
+
+// Histogram counts observations in buckets of upper bounds.
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	// counts are not cumulative. The last one is for values above all bounds.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates a histogram with the sorted bucket upper bounds.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Observe adds the value v.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+// HistogramSnapshot is the state of a histogram. Buckets are cumulative
+// counts of values less than or equal to the bounds.
+type HistogramSnapshot struct {
+	Bounds  []float64 `json:"bounds"`
+	Buckets []uint64  `json:"buckets"`
+	Sum     float64   `json:"sum"`
+	Count   uint64    `json:"count"`
+}
+
+// Snapshot returns the current state of the histogram.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := HistogramSnapshot{
+		Bounds:  h.bounds,
+		Buckets: make([]uint64, len(h.bounds)),
+		Sum:     h.sum,
+		Count:   h.count,
+	}
+	var n uint64
+	for i := range h.bounds {
+		n += h.counts[i]
+		s.Buckets[i] = n
+	}
+	return s
+}
+
+// Buckets of RTT in seconds and congestion window in bytes.
+var (
+	rttBuckets  = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+	cwndBuckets = []float64{4096, 8192, 16384, 32768, 65536, 131072, 262144, 524288, 1048576, 2097152, 4194304}
+)
+
+// Close reasons.
+const (
+	// The connection was closed locally with an application error.
+	CloseLocalApplication = "local_application"
+	// The connection was closed locally with a transport error.
+	CloseLocalTransport = "local_transport"
+	// The connection was closed by the peer or timed out.
+	CloseRemoteOrTimeout = "remote_or_timeout"
+	// The connection was freed before it was closed, e.g. when the server
+	// stopped waiting for connections to drain.
+	CloseFreed = "freed"
+)
+
+// Metrics is a collection of listener and connection metrics.
+// It is safe for concurrent use.
+type Metrics struct {
+	ActiveConnections       Gauge
+	HandshakesStarted       Counter
+	HandshakesCompleted     Counter
+	HandshakesFailed        Counter
+	RetriesSent             Counter
+	VersionNegotiationsSent Counter
+	PacketsReceived         Counter
+	PacketsSent             Counter
+	BytesReceived           Counter
+	BytesSent               Counter
+	PacketsLost             Counter
+	// RTT is in seconds and CWnd is in bytes.
+	RTT  *Histogram
+	CWnd *Histogram
+	// Closes are counted by reason.
+	Closes *CounterVec
+	// PacketsRejected are packets initiating new connections which were
+	// rejected, counted by reason.
+	PacketsRejected *CounterVec
+
+	namespace string
+	metrics   []metric
+}
+
+type metric struct {
+	name string
+	help string
+	typ  string
+	// value is a *Counter, *Gauge, *CounterVec or *Histogram.
+	value interface{}
+}
+
+// New creates metrics whose names in Prometheus format are prefixed with
+// namespace and an underscore.
+func New(namespace string) *Metrics {
+	m := &Metrics{
+		RTT:       NewHistogram(rttBuckets),
+		CWnd:      NewHistogram(cwndBuckets),
+		Closes:    NewCounterVec("reason"),
+		namespace: namespace,
+
+		PacketsRejected: NewCounterVec("reason"),
+	}
+	m.metrics = []metric{
+		{"active_connections", "Number of open connections.", "gauge", &m.ActiveConnections},
+		{"handshakes_started_total", "Number of handshakes started.", "counter", &m.HandshakesStarted},
+		{"handshakes_completed_total", "Number of handshakes completed.", "counter", &m.HandshakesCompleted},
+		{"handshakes_failed_total", "Number of connections closed before the handshake completed.", "counter", &m.HandshakesFailed},
+		{"retries_sent_total", "Number of stateless retry packets sent.", "counter", &m.RetriesSent},
+		{"version_negotiations_sent_total", "Number of version negotiation packets sent.", "counter", &m.VersionNegotiationsSent},
+		{"packets_received_total", "Number of datagrams received by connections.", "counter", &m.PacketsReceived},
+		{"packets_sent_total", "Number of datagrams sent by connections.", "counter", &m.PacketsSent},
+		{"bytes_received_total", "Number of bytes received by connections at UDP level.", "counter", &m.BytesReceived},
+		{"bytes_sent_total", "Number of bytes sent by connections at UDP level.", "counter", &m.BytesSent},
+		{"packets_lost_total", "Number of QUIC packets lost.", "counter", &m.PacketsLost},
+		{"rtt_seconds", "Sampled round-trip time estimates of connections.", "histogram", m.RTT},
+		{"cwnd_bytes", "Sampled congestion window sizes of connections.", "histogram", m.CWnd},
+		{"connections_closed_total", "Number of connections closed by reason.", "counter", m.Closes},
+		{"packets_rejected_total", "Number of packets initiating new connections rejected by reason.", "counter", m.PacketsRejected},
+	}
+	return m
+}
+
+// ObserveRTT adds a sample of round-trip time.
+func (m *Metrics) ObserveRTT(rtt time.Duration) {
+	m.RTT.Observe(rtt.Seconds())
+}
+
+// ObserveCWnd adds a sample of congestion window size.
+func (m *Metrics) ObserveCWnd(cwnd uint64) {
+	m.CWnd.Observe(float64(cwnd))
+}
+
+// WritePrometheus writes all metrics in Prometheus text exposition format.
+func (m *Metrics) WritePrometheus(b *bytes.Buffer) {
+	for _, v := range m.metrics {
+		name := v.name
+		if m.namespace != "" {
+			name = m.namespace + "_" + name
+		}
+		b.WriteString("# HELP ")
+		b.WriteString(name)
+		b.WriteByte(' ')
+		b.WriteString(v.help)
+		b.WriteString("\n# TYPE ")
+		b.WriteString(name)
+		b.WriteByte(' ')
+		b.WriteString(v.typ)
+		b.WriteByte('\n')
+		switch x := v.value.(type) {
+		case *Counter:
+			writeSample(b, name, "", "", float64(x.Value()))
+		case *Gauge:
+			writeSample(b, name, "", "", float64(x.Value()))
+		case *CounterVec:
+			values := x.Values()
+			keys := make([]string, 0, len(values))
+			for k := range values {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				writeSample(b, name, x.label, k, float64(values[k]))
+			}
+		case *Histogram:
+			s := x.Snapshot()
+			for i, bound := range s.Bounds {
+				writeSample(b, name+"_bucket", "le", formatFloat(bound), float64(s.Buckets[i]))
+			}
+			writeSample(b, name+"_bucket", "le", "+Inf", float64(s.Count))
+			writeSample(b, name+"_sum", "", "", s.Sum)
+			writeSample(b, name+"_count", "", "", float64(s.Count))
+		}
+	}
+}
+
+func writeSample(b *bytes.Buffer, name, label, value string, v float64) {
+	b.WriteString(name)
+	if label != "" {
+		b.WriteByte('{')
+		b.WriteString(label)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(value))
+		b.WriteString(`"}`)
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(v))
+	b.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeLabel(s string) string {
+	var b bytes.Buffer
+	for _, c := range s {
+		switch c {
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\n':
+			b.WriteString(`\n`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// ServeHTTP writes all metrics in Prometheus text exposition format so that
+// the metrics can be scraped by a Prometheus compatible collector.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	m.WritePrometheus(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// Snapshot returns the current values of all metrics by name.
+func (m *Metrics) Snapshot() map[string]interface{} {
+	s := make(map[string]interface{}, len(m.metrics))
+	for _, v := range m.metrics {
+		switch x := v.value.(type) {
+		case *Counter:
+			s[v.name] = x.Value()
+		case *Gauge:
+			s[v.name] = x.Value()
+		case *CounterVec:
+			s[v.name] = x.Values()
+		case *Histogram:
+			s[v.name] = x.Snapshot()
+		}
+	}
+	return s
+}
+
+// Publish exports the metrics snapshot through expvar with the name.
+// Like expvar.Publish, it panics if the name is already registered.
+func (m *Metrics) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return m.Snapshot()
+	}))
+}
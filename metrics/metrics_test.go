@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{1, 2, 5})
+	for _, v := range []float64{0.5, 1, 1.5, 3, 10} {
+		h.Observe(v)
+	}
+	s := h.Snapshot()
+	want := []uint64{2, 3, 4}
+	for i, n := range want {
+		if s.Buckets[i] != n {
+			t.Fatalf("unexpected buckets: want %v, actual %v", want, s.Buckets)
+		}
+	}
+	if s.Count != 5 || s.Sum != 16 {
+		t.Fatalf("unexpected count %d or sum %v", s.Count, s.Sum)
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	m := New("quiche")
+	m.ActiveConnections.Inc()
+	m.HandshakesStarted.Add(3)
+	m.Closes.With(CloseLocalApplication).Inc()
+	m.Closes.With(CloseRemoteOrTimeout).Add(2)
+	m.PacketsRejected.With("rate_limited").Inc()
+	m.ObserveRTT(20 * time.Millisecond)
+	m.ObserveCWnd(10000)
+
+	var b bytes.Buffer
+	m.WritePrometheus(&b)
+	out := b.String()
+	lines := []string{
+		"# TYPE quiche_active_connections gauge\nquiche_active_connections 1\n",
+		"# TYPE quiche_handshakes_started_total counter\nquiche_handshakes_started_total 3\n",
+		`quiche_connections_closed_total{reason="local_application"} 1` + "\n" +
+			`quiche_connections_closed_total{reason="remote_or_timeout"} 2` + "\n",
+		`quiche_packets_rejected_total{reason="rate_limited"} 1` + "\n",
+		`quiche_rtt_seconds_bucket{le="0.01"} 0` + "\n" +
+			`quiche_rtt_seconds_bucket{le="0.025"} 1` + "\n",
+		`quiche_rtt_seconds_bucket{le="+Inf"} 1` + "\nquiche_rtt_seconds_sum 0.02\nquiche_rtt_seconds_count 1\n",
+		`quiche_cwnd_bytes_bucket{le="16384"} 1` + "\n",
+	}
+	for _, line := range lines {
+		if !strings.Contains(out, line) {
+			t.Errorf("missing %q in output:\n%s", line, out)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	m := New("")
+	m.RetriesSent.Inc()
+	m.Closes.With(CloseLocalTransport).Inc()
+	s := m.Snapshot()
+	if s["retries_sent_total"] != uint64(1) {
+		t.Fatalf("unexpected retries: %v", s["retries_sent_total"])
+	}
+	closes := s["connections_closed_total"].(map[string]uint64)
+	if closes[CloseLocalTransport] != 1 {
+		t.Fatalf("unexpected closes: %v", closes)
+	}
+	if _, ok := s["rtt_seconds"].(HistogramSnapshot); !ok {
+		t.Fatalf("unexpected rtt: %#v", s["rtt_seconds"])
+	}
+}
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"github.com/goburrow/quiche"
+)
+
+// ConnectionTracer updates metrics with events of a traced connection.
+// It must only be used by the loop owning the connection.
+type ConnectionTracer struct {
+	m           *Metrics
+	established bool
+	closed      bool
+	freed       bool
+	lost        uint64
+}
+
+// NewConnectionTracer counts a new connection whose handshake is started.
+// The returned tracer must be closed when the connection is freed.
+func (m *Metrics) NewConnectionTracer() *ConnectionTracer {
+	m.ActiveConnections.Inc()
+	m.HandshakesStarted.Inc()
+	return &ConnectionTracer{m: m}
+}
+
+// TraceEvent implements quiche.Tracer.
+func (t *ConnectionTracer) TraceEvent(e *quiche.TraceEvent) {
+	m := t.m
+	switch e.Type {
+	case quiche.TracePacketReceived:
+		m.PacketsReceived.Inc()
+		m.BytesReceived.Add(uint64(e.PacketSize))
+	case quiche.TracePacketSent:
+		m.PacketsSent.Inc()
+		m.BytesSent.Add(uint64(e.PacketSize))
+	case quiche.TraceHandshakeCompleted:
+		if !t.established {
+			t.established = true
+			m.HandshakesCompleted.Inc()
+		}
+	case quiche.TraceConnectionClosed:
+		reason := CloseRemoteOrTimeout
+		if e.Local {
+			if e.App {
+				reason = CloseLocalApplication
+			} else {
+				reason = CloseLocalTransport
+			}
+		}
+		t.close(reason)
+	case quiche.TraceStats:
+		// Stats are cumulative.
+		if e.Stats.Lost > t.lost {
+			m.PacketsLost.Add(e.Stats.Lost - t.lost)
+			t.lost = e.Stats.Lost
+		}
+		if e.Stats.RTT > 0 {
+			m.ObserveRTT(e.Stats.RTT)
+		}
+		if e.Stats.CWnd > 0 {
+			m.ObserveCWnd(e.Stats.CWnd)
+		}
+	}
+}
+
+func (t *ConnectionTracer) close(reason string) {
+	if t.closed {
+		return
+	}
+	t.closed = true
+	if !t.established {
+		t.m.HandshakesFailed.Inc()
+	}
+	t.m.Closes.With(reason).Inc()
+}
+
+// Close removes the connection from active connections. The connection is
+// counted as closed with reason CloseFreed if it has not been closed.
+func (t *ConnectionTracer) Close() {
+	if t.freed {
+		return
+	}
+	t.freed = true
+	t.close(CloseFreed)
+	t.m.ActiveConnections.Dec()
+}
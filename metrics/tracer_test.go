@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goburrow/quiche"
+)
+
+func TestConnectionTracer(t *testing.T) {
+	m := New("")
+	tr := m.NewConnectionTracer()
+	events := []quiche.TraceEvent{
+		{Type: quiche.TracePacketReceived, PacketSize: 1200},
+		{Type: quiche.TracePacketSent, PacketSize: 1000},
+		{Type: quiche.TraceHandshakeCompleted},
+		{Type: quiche.TraceStats, Stats: quiche.Stats{Lost: 2, RTT: 10 * time.Millisecond, CWnd: 14720}},
+		{Type: quiche.TraceStats, Stats: quiche.Stats{Lost: 3, RTT: 12 * time.Millisecond, CWnd: 14720}},
+		{Type: quiche.TraceConnectionClosed, Local: true, App: true},
+		{Type: quiche.TraceConnectionClosed},
+	}
+	for i := range events {
+		tr.TraceEvent(&events[i])
+	}
+	if m.ActiveConnections.Value() != 1 {
+		t.Fatalf("unexpected active connections: %d", m.ActiveConnections.Value())
+	}
+	tr.Close()
+	tr.Close()
+	if m.ActiveConnections.Value() != 0 {
+		t.Fatalf("unexpected active connections: %d", m.ActiveConnections.Value())
+	}
+	if m.BytesReceived.Value() != 1200 || m.BytesSent.Value() != 1000 {
+		t.Fatalf("unexpected bytes: received %d, sent %d", m.BytesReceived.Value(), m.BytesSent.Value())
+	}
+	if m.HandshakesCompleted.Value() != 1 || m.HandshakesFailed.Value() != 0 {
+		t.Fatalf("unexpected handshakes: completed %d, failed %d",
+			m.HandshakesCompleted.Value(), m.HandshakesFailed.Value())
+	}
+	if m.PacketsLost.Value() != 3 {
+		t.Fatalf("unexpected lost packets: %d", m.PacketsLost.Value())
+	}
+	if m.RTT.Snapshot().Count != 2 {
+		t.Fatalf("unexpected rtt samples: %d", m.RTT.Snapshot().Count)
+	}
+	closes := m.Closes.Values()
+	if len(closes) != 1 || closes[CloseLocalApplication] != 1 {
+		t.Fatalf("unexpected closes: %v", closes)
+	}
+
+	tr = m.NewConnectionTracer()
+	tr.TraceEvent(&quiche.TraceEvent{Type: quiche.TraceConnectionClosed})
+	tr.Close()
+	if m.HandshakesFailed.Value() != 1 || m.Closes.Values()[CloseRemoteOrTimeout] != 1 {
+		t.Fatalf("unexpected failed handshakes %d or closes %v", m.HandshakesFailed.Value(), m.Closes.Values())
+	}
+
+	// Freed without being closed, e.g. when draining timed out.
+	tr = m.NewConnectionTracer()
+	tr.Close()
+	tr.Close()
+	if m.HandshakesFailed.Value() != 2 || m.Closes.Values()[CloseFreed] != 1 {
+		t.Fatalf("unexpected failed handshakes %d or closes %v", m.HandshakesFailed.Value(), m.Closes.Values())
+	}
+	if m.ActiveConnections.Value() != 0 {
+		t.Fatalf("unexpected active connections: %d", m.ActiveConnections.Value())
+	}
+}
@@ -0,0 +1,218 @@
+package quiche
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goburrow/quiche/internal/netsim"
+)
+
+func TestHandshakeWithLoss(t *testing.T) {
+	p := newConnPair(t, nil)
+	defer p.free()
+	client, server := p.client, p.server
+
+	n := netsim.New(1, ErrDone)
+	link := netsim.LinkConfig{
+		Latency: 10 * time.Millisecond,
+		Jitter:  5 * time.Millisecond,
+		Loss:    0.3,
+	}
+	c, s := n.Connect(client, server, link, link)
+	err := n.Run(func() bool {
+		return client.IsEstablished() && server.IsEstablished()
+	}, 30*time.Second)
+	if err != nil {
+		t.Fatalf("handshake: %v, client=%v server=%v", err, client.IsEstablished(), server.IsEstablished())
+	}
+	if n.LinkStats(c).Lost+n.LinkStats(s).Lost == 0 {
+		t.Fatalf("no datagrams lost: client %+v, server %+v", n.LinkStats(c), n.LinkStats(s))
+	}
+	var stats Stats
+	client.Stats(&stats)
+	t.Logf("client stats: %s, link: %+v", &stats, n.LinkStats(c))
+	server.Stats(&stats)
+	t.Logf("server stats: %s, link: %+v", &stats, n.LinkStats(s))
+}
+
+func TestHandshakeSeed(t *testing.T) {
+	if !netsim.VirtualClock {
+		t.Skip("virtual clock is not supported")
+	}
+	type result struct {
+		now            time.Duration
+		client, server netsim.LinkStats
+	}
+	var results [2]result
+	for i := range results {
+		p := newConnPair(t, nil)
+		n := netsim.New(4, ErrDone)
+		link := netsim.LinkConfig{
+			Latency: 10 * time.Millisecond,
+			Jitter:  5 * time.Millisecond,
+			Loss:    0.2,
+		}
+		c, s := n.Connect(p.client, p.server, link, link)
+		err := n.Run(func() bool {
+			return p.client.IsEstablished() && p.server.IsEstablished()
+		}, 30*time.Second)
+		if err != nil {
+			p.free()
+			t.Fatal(err)
+		}
+		results[i] = result{n.Now(), n.LinkStats(c), n.LinkStats(s)}
+		p.free()
+	}
+	if results[0] != results[1] {
+		t.Fatalf("handshakes with the same seed differ:\n%+v\n%+v", results[0], results[1])
+	}
+	// The handshake takes at least two round trips.
+	if results[0].now < 40*time.Millisecond {
+		t.Fatalf("latency is not seen by endpoints: %v", results[0].now)
+	}
+}
+
+func TestStreamTransferWithReorder(t *testing.T) {
+	p := newConnPair(t, nil)
+	defer p.free()
+	client, server := p.client, p.server
+
+	n := netsim.New(2, ErrDone)
+	link := netsim.LinkConfig{
+		Latency:   20 * time.Millisecond,
+		Jitter:    10 * time.Millisecond,
+		Duplicate: 0.1,
+		Reorder:   0.2,
+		Bandwidth: 1000000,
+		MTU:       1350,
+	}
+	n.Connect(client, server, link, link)
+	err := n.Run(func() bool {
+		return client.IsEstablished() && server.IsEstablished()
+	}, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stream data is limited to 15 bytes by defaultConfig.
+	const streamID = 4
+	data := []byte("0123456789abcde")
+	sent, err := client.StreamSend(streamID, data, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != len(data) {
+		t.Fatalf("unexpected sent bytes: want %d, actual %d", len(data), sent)
+	}
+	var received []byte
+	var fin bool
+	buf := make([]byte, 100)
+	err = n.Run(func() bool {
+		for {
+			id, ok := server.ReadableNext()
+			if !ok {
+				break
+			}
+			m, f, err := server.StreamRecv(id, buf)
+			if err != nil && err != ErrDone {
+				t.Fatal(err)
+			}
+			received = append(received, buf[:m]...)
+			fin = fin || f
+		}
+		return fin
+	}, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(received) != string(data) {
+		t.Fatalf("unexpected received data: want %q, actual %q", data, received)
+	}
+}
+
+func TestFlowControlWithLoss(t *testing.T) {
+	p := newConnPair(t, nil)
+	defer p.free()
+	client, server := p.client, p.server
+
+	n := netsim.New(5, ErrDone)
+	link := netsim.LinkConfig{
+		Latency: 10 * time.Millisecond,
+		Loss:    0.1,
+	}
+	n.Connect(client, server, link, link)
+	err := n.Run(func() bool {
+		return client.IsEstablished() && server.IsEstablished()
+	}, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// defaultConfig allows 15 bytes per stream so the data is only sent
+	// after the server reads and the credit update is not lost.
+	const streamID = 4
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte('a' + i%26)
+	}
+	pending := data
+	var received []byte
+	var fin bool
+	buf := make([]byte, 100)
+	err = n.Run(func() bool {
+		if len(pending) > 0 {
+			m, err := client.StreamSend(streamID, pending, true)
+			if err != nil && err != ErrDone {
+				t.Fatal(err)
+			}
+			if len(received)+15 < len(data)-len(pending)+m {
+				t.Fatalf("sent beyond stream credit: received %d, sent %d", len(received), len(data)-len(pending)+m)
+			}
+			pending = pending[m:]
+		}
+		for {
+			id, ok := server.ReadableNext()
+			if !ok {
+				break
+			}
+			m, f, err := server.StreamRecv(id, buf)
+			if err != nil && err != ErrDone {
+				t.Fatal(err)
+			}
+			received = append(received, buf[:m]...)
+			fin = fin || f
+		}
+		return fin
+	}, 30*time.Second)
+	if err != nil {
+		t.Fatalf("transfer: %v, received %d bytes", err, len(received))
+	}
+	if string(received) != string(data) {
+		t.Fatalf("unexpected received data: %q", received)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	p := newConnPair(t, func(config *Config) {
+		config.SetIdleTimeout(100 * time.Millisecond)
+	})
+	defer p.free()
+	client, server := p.client, p.server
+
+	n := netsim.New(3, ErrDone)
+	link := netsim.LinkConfig{Latency: 5 * time.Millisecond}
+	n.Connect(client, server, link, link)
+	err := n.Run(func() bool {
+		return client.IsEstablished() && server.IsEstablished()
+	}, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is sent after the handshake so both sides time out.
+	err = n.Run(func() bool {
+		return client.IsClosed() && server.IsClosed()
+	}, 10*time.Second)
+	if err != nil {
+		t.Fatalf("idle timeout: %v, client=%v server=%v", err, client.IsClosed(), server.IsClosed())
+	}
+}
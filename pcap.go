@@ -0,0 +1,183 @@
+package quiche
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// pcapng block types and constants.
+const (
+	pcapngSectionHeader   = 0x0a0d0d0a
+	pcapngInterface       = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1a2b3c4d
+	pcapngLinkTypeRaw     = 101 // Packets begin with an IPv4 or IPv6 header.
+	pcapngOptIfTSResol    = 9
+	pcapngTSResolNanosecs = 9
+
+	pcapngSectionHeaderLen  = 28
+	pcapngInterfaceLen      = 32
+	pcapngEnhancedPacketLen = 32 // Without packet data.
+)
+
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+	ipProtoUDP    = 17
+	ipTTL         = 64
+)
+
+// PcapWriter writes UDP datagrams to a pcapng stream. Each datagram is
+// prefixed with synthetic IP and UDP headers so that it can be dissected as
+// QUIC. It is safe for concurrent use.
+type PcapWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+// NewPcapWriter writes the pcapng section header and interface description
+// blocks to w and returns a writer for packets.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	le := binary.LittleEndian
+	var b [pcapngSectionHeaderLen + pcapngInterfaceLen]byte
+	// Section header block.
+	le.PutUint32(b[0:], pcapngSectionHeader)
+	le.PutUint32(b[4:], pcapngSectionHeaderLen)
+	le.PutUint32(b[8:], pcapngByteOrderMagic)
+	le.PutUint16(b[12:], 1)          // Major version.
+	le.PutUint16(b[14:], 0)          // Minor version.
+	le.PutUint64(b[16:], ^uint64(0)) // Section length is not specified.
+	le.PutUint32(b[24:], pcapngSectionHeaderLen)
+	// Interface description block with nanosecond timestamps.
+	i := b[pcapngSectionHeaderLen:]
+	le.PutUint32(i[0:], pcapngInterface)
+	le.PutUint32(i[4:], pcapngInterfaceLen)
+	le.PutUint16(i[8:], pcapngLinkTypeRaw)
+	le.PutUint32(i[12:], 0) // No snapshot length limit.
+	le.PutUint16(i[16:], pcapngOptIfTSResol)
+	le.PutUint16(i[18:], 1)
+	i[20] = pcapngTSResolNanosecs
+	// Option is padded to 32 bits, followed by end of options.
+	le.PutUint32(i[28:], pcapngInterfaceLen)
+	_, err := w.Write(b[:])
+	if err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// WritePacket writes the UDP payload b sent from src to dst at time t.
+func (p *PcapWriter) WritePacket(t time.Time, src, dst *net.UDPAddr, b []byte) error {
+	if src == nil || dst == nil {
+		return errors.New("pcap: missing address")
+	}
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	ipv4 := src4 != nil && dst4 != nil
+	ipLen := ipv6HeaderLen
+	if ipv4 {
+		ipLen = ipv4HeaderLen
+	}
+	n := ipLen + udpHeaderLen + len(b)
+	total := pcapngEnhancedPacketLen + (n+3)&^3
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cap(p.buf) < total {
+		p.buf = make([]byte, total)
+	}
+	buf := p.buf[:total]
+	for i := range buf {
+		buf[i] = 0
+	}
+	le := binary.LittleEndian
+	ts := uint64(t.UnixNano())
+	le.PutUint32(buf[0:], pcapngEnhancedPacket)
+	le.PutUint32(buf[4:], uint32(total))
+	le.PutUint32(buf[8:], 0) // Interface ID.
+	le.PutUint32(buf[12:], uint32(ts>>32))
+	le.PutUint32(buf[16:], uint32(ts))
+	le.PutUint32(buf[20:], uint32(n)) // Captured length.
+	le.PutUint32(buf[24:], uint32(n)) // Original length.
+	le.PutUint32(buf[total-4:], uint32(total))
+	pkt := buf[28 : 28+n]
+	var srcIP, dstIP net.IP
+	if ipv4 {
+		srcIP, dstIP = src4, dst4
+		putIPv4Header(pkt, srcIP, dstIP, n)
+	} else {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		putIPv6Header(pkt, srcIP, dstIP, n-ipLen)
+	}
+	udp := pkt[ipLen:]
+	copy(udp[udpHeaderLen:], b)
+	putUDPHeader(udp, srcIP, dstIP, src.Port, dst.Port)
+	_, err := p.w.Write(buf)
+	return err
+}
+
+func putIPv4Header(b []byte, src, dst net.IP, totalLen int) {
+	be := binary.BigEndian
+	b[0] = 0x45 // Version and header length.
+	be.PutUint16(b[2:], uint16(totalLen))
+	be.PutUint16(b[6:], 0x4000) // Don't fragment.
+	b[8] = ipTTL
+	b[9] = ipProtoUDP
+	copy(b[12:16], src)
+	copy(b[16:20], dst)
+	be.PutUint16(b[10:], ^foldChecksum(checksum(0, b[:ipv4HeaderLen])))
+}
+
+func putIPv6Header(b []byte, src, dst net.IP, payloadLen int) {
+	be := binary.BigEndian
+	be.PutUint32(b[0:], 6<<28)
+	be.PutUint16(b[4:], uint16(payloadLen))
+	b[6] = ipProtoUDP
+	b[7] = ipTTL
+	copy(b[8:24], src)
+	copy(b[24:40], dst)
+}
+
+// putUDPHeader writes the header of the UDP datagram b, whose payload has
+// been copied.
+func putUDPHeader(b []byte, src, dst net.IP, srcPort, dstPort int) {
+	be := binary.BigEndian
+	be.PutUint16(b[0:], uint16(srcPort))
+	be.PutUint16(b[2:], uint16(dstPort))
+	be.PutUint16(b[4:], uint16(len(b)))
+	// Checksum covers the pseudo header and the whole datagram.
+	sum := checksum(0, src)
+	sum = checksum(sum, dst)
+	sum += ipProtoUDP + uint32(len(b))
+	sum = checksum(sum, b)
+	c := ^foldChecksum(sum)
+	if c == 0 {
+		c = 0xffff
+	}
+	be.PutUint16(b[6:], c)
+}
+
+// checksum adds b as big-endian 16-bit words to the one's complement sum.
+// Odd length b is padded with zero.
+func checksum(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) > 0 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func foldChecksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,97 @@
+package quiche
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPcapWriter(t *testing.T) {
+	var out bytes.Buffer
+	w, err := NewPcapWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 123456789)
+	packets := []struct {
+		src, dst *net.UDPAddr
+		ipLen    int
+	}{
+		{
+			src:   &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4433},
+			dst:   &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000},
+			ipLen: ipv4HeaderLen,
+		},
+		{
+			src:   &net.UDPAddr{IP: net.ParseIP("::1"), Port: 4433},
+			dst:   &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50000},
+			ipLen: ipv6HeaderLen,
+		},
+	}
+	payload := []byte("hello, quic")
+	for _, p := range packets {
+		err = w.WritePacket(now, p.src, p.dst, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	le := binary.LittleEndian
+	b := out.Bytes()
+	if le.Uint32(b) != pcapngSectionHeader || le.Uint32(b[8:]) != pcapngByteOrderMagic {
+		t.Fatalf("invalid section header: %x", b[:pcapngSectionHeaderLen])
+	}
+	b = b[pcapngSectionHeaderLen:]
+	if le.Uint32(b) != pcapngInterface || le.Uint16(b[8:]) != pcapngLinkTypeRaw {
+		t.Fatalf("invalid interface description: %x", b[:pcapngInterfaceLen])
+	}
+	b = b[pcapngInterfaceLen:]
+	for _, p := range packets {
+		total := int(le.Uint32(b[4:]))
+		if le.Uint32(b) != pcapngEnhancedPacket || total%4 != 0 || le.Uint32(b[total-4:]) != uint32(total) {
+			t.Fatalf("invalid enhanced packet block: %x", b)
+		}
+		ts := uint64(le.Uint32(b[12:]))<<32 | uint64(le.Uint32(b[16:]))
+		if ts != uint64(now.UnixNano()) {
+			t.Fatalf("unexpected timestamp: %d", ts)
+		}
+		n := int(le.Uint32(b[20:]))
+		if n != p.ipLen+udpHeaderLen+len(payload) {
+			t.Fatalf("unexpected captured length: %d", n)
+		}
+		pkt := b[28 : 28+n]
+		var src, dst net.IP
+		if p.ipLen == ipv4HeaderLen {
+			if foldChecksum(checksum(0, pkt[:ipv4HeaderLen])) != 0xffff {
+				t.Fatalf("invalid IPv4 header checksum: %x", pkt[:ipv4HeaderLen])
+			}
+			src, dst = pkt[12:16], pkt[16:20]
+		} else {
+			if pkt[0]>>4 != 6 || pkt[6] != ipProtoUDP {
+				t.Fatalf("invalid IPv6 header: %x", pkt[:ipv6HeaderLen])
+			}
+			src, dst = pkt[8:24], pkt[24:40]
+		}
+		if !src.Equal(p.src.IP) || !dst.Equal(p.dst.IP) {
+			t.Fatalf("unexpected addresses: %s -> %s", src, dst)
+		}
+		udp := pkt[p.ipLen:]
+		if int(binary.BigEndian.Uint16(udp)) != p.src.Port || int(binary.BigEndian.Uint16(udp[2:])) != p.dst.Port {
+			t.Fatalf("unexpected ports: %x", udp[:udpHeaderLen])
+		}
+		sum := checksum(0, src)
+		sum = checksum(sum, dst)
+		sum += ipProtoUDP + uint32(len(udp))
+		if foldChecksum(checksum(sum, udp)) != 0xffff {
+			t.Fatalf("invalid UDP checksum: %x", udp[:udpHeaderLen])
+		}
+		if !bytes.Equal(udp[udpHeaderLen:], payload) {
+			t.Fatalf("unexpected payload: %x", udp[udpHeaderLen:])
+		}
+		b = b[total:]
+	}
+	if len(b) != 0 {
+		t.Fatalf("unexpected trailing data: %x", b)
+	}
+}
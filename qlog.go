@@ -0,0 +1,212 @@
+package quiche
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+const (
+	qlogVersion = "0.3"
+	qlogFormat  = "JSON-SEQ"
+	// qlogRecordSeparator precedes each record in JSON text sequences (RFC 7464).
+	qlogRecordSeparator = 0x1e
+)
+
+// QlogWriter is a Tracer writing events in qlog JSON-SEQ format, which can
+// be loaded by qlog viewers such as qvis. Event times are relative to the
+// creation of the writer. It is not safe for concurrent use.
+type QlogWriter struct {
+	w     io.Writer
+	start time.Time
+	buf   bytes.Buffer
+	enc   *json.Encoder
+	err   error
+}
+
+type qlogHeader struct {
+	QlogVersion string    `json:"qlog_version"`
+	QlogFormat  string    `json:"qlog_format"`
+	Title       string    `json:"title,omitempty"`
+	Trace       qlogTrace `json:"trace"`
+}
+
+type qlogTrace struct {
+	VantagePoint qlogVantagePoint `json:"vantage_point"`
+	CommonFields qlogCommonFields `json:"common_fields"`
+}
+
+type qlogVantagePoint struct {
+	Type string `json:"type"`
+}
+
+type qlogCommonFields struct {
+	ODCID         string  `json:"ODCID,omitempty"`
+	TimeFormat    string  `json:"time_format"`
+	ReferenceTime float64 `json:"reference_time"`
+}
+
+type qlogEvent struct {
+	Time float64     `json:"time"`
+	Name string      `json:"name"`
+	Data interface{} `json:"data"`
+}
+
+type qlogPacketHeader struct {
+	PacketType string `json:"packet_type"`
+	DCID       string `json:"dcid,omitempty"`
+}
+
+type qlogRawInfo struct {
+	Length int `json:"length"`
+}
+
+type qlogPacket struct {
+	Header qlogPacketHeader `json:"header"`
+	Raw    qlogRawInfo      `json:"raw"`
+}
+
+type qlogStreamState struct {
+	StreamID uint64 `json:"stream_id"`
+	New      string `json:"new"`
+}
+
+type qlogStateUpdated struct {
+	New string `json:"new"`
+}
+
+type qlogTimerUpdated struct {
+	EventType string `json:"event_type"`
+}
+
+type qlogConnectionClosed struct {
+	Owner           string  `json:"owner"`
+	ConnectionCode  *uint16 `json:"connection_code,omitempty"`
+	ApplicationCode *uint16 `json:"application_code,omitempty"`
+	Reason          string  `json:"reason,omitempty"`
+}
+
+type qlogMetrics struct {
+	SmoothedRTT      float64 `json:"smoothed_rtt"`
+	CongestionWindow uint64  `json:"congestion_window"`
+	PacketsSent      uint64  `json:"packets_sent"`
+	PacketsReceived  uint64  `json:"packets_received"`
+	PacketsLost      uint64  `json:"packets_lost"`
+}
+
+// NewQlogWriter writes the qlog header of a trace to w. vantagePoint is
+// either "client" or "server" and odcid is the original destination
+// connection ID, which identifies the connection in viewers.
+func NewQlogWriter(w io.Writer, vantagePoint string, odcid []byte) (*QlogWriter, error) {
+	q := &QlogWriter{
+		w:     w,
+		start: time.Now(),
+	}
+	q.enc = json.NewEncoder(&q.buf)
+	err := q.write(&qlogHeader{
+		QlogVersion: qlogVersion,
+		QlogFormat:  qlogFormat,
+		Title:       "quiche-go",
+		Trace: qlogTrace{
+			VantagePoint: qlogVantagePoint{Type: vantagePoint},
+			CommonFields: qlogCommonFields{
+				ODCID:         hex.EncodeToString(odcid),
+				TimeFormat:    "relative",
+				ReferenceTime: durationMillis(time.Duration(q.start.UnixNano())),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// TraceEvent writes the event as a qlog record.
+func (q *QlogWriter) TraceEvent(e *TraceEvent) {
+	ev := qlogEvent{
+		Time: durationMillis(e.Time.Sub(q.start)),
+	}
+	switch e.Type {
+	case TracePacketReceived, TracePacketSent:
+		ev.Name = "transport:packet_received"
+		if e.Type == TracePacketSent {
+			ev.Name = "transport:packet_sent"
+		}
+		ev.Data = &qlogPacket{
+			Header: qlogPacketHeader{
+				PacketType: e.PacketType,
+				DCID:       hex.EncodeToString(e.DCID),
+			},
+			Raw: qlogRawInfo{Length: e.PacketSize},
+		}
+	case TraceStreamOpened, TraceStreamClosed:
+		ev.Name = "transport:stream_state_updated"
+		st := &qlogStreamState{StreamID: e.StreamID, New: "open"}
+		if e.Type == TraceStreamClosed {
+			st.New = "closed"
+		}
+		ev.Data = st
+	case TraceTimeout:
+		ev.Name = "recovery:loss_timer_updated"
+		ev.Data = &qlogTimerUpdated{EventType: "expired"}
+	case TraceHandshakeCompleted:
+		ev.Name = "connectivity:connection_state_updated"
+		ev.Data = &qlogStateUpdated{New: "handshake_complete"}
+	case TraceConnectionClosed:
+		if !e.Local {
+			// The error sent by the peer is not available.
+			ev.Name = "connectivity:connection_state_updated"
+			ev.Data = &qlogStateUpdated{New: "closed"}
+			break
+		}
+		ev.Name = "connectivity:connection_closed"
+		cc := &qlogConnectionClosed{
+			Owner:  "local",
+			Reason: string(e.Reason),
+		}
+		code := e.ErrorCode
+		if e.App {
+			cc.ApplicationCode = &code
+		} else {
+			cc.ConnectionCode = &code
+		}
+		ev.Data = cc
+	case TraceStats:
+		ev.Name = "recovery:metrics_updated"
+		ev.Data = &qlogMetrics{
+			SmoothedRTT:      durationMillis(e.Stats.RTT),
+			CongestionWindow: e.Stats.CWnd,
+			PacketsSent:      e.Stats.Sent,
+			PacketsReceived:  e.Stats.Recv,
+			PacketsLost:      e.Stats.Lost,
+		}
+	default:
+		return
+	}
+	q.write(&ev)
+}
+
+// Err returns the first error occurred when writing events.
+func (q *QlogWriter) Err() error {
+	return q.err
+}
+
+// write writes v as a JSON text sequence record. Writing stops after the
+// first error.
+func (q *QlogWriter) write(v interface{}) error {
+	if q.err != nil {
+		return q.err
+	}
+	q.buf.Reset()
+	q.buf.WriteByte(qlogRecordSeparator)
+	// Encode appends the newline ending the record.
+	err := q.enc.Encode(v)
+	if err == nil {
+		_, err = q.w.Write(q.buf.Bytes())
+	}
+	q.err = err
+	return err
+}
@@ -0,0 +1,116 @@
+package quiche
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPacketType(t *testing.T) {
+	tests := []struct {
+		b   []byte
+		typ string
+	}{
+		{nil, ""},
+		{[]byte{0x40, 1, 2, 3}, PacketType1RTT},
+		{[]byte{0xc0, 0xff, 0, 0}, ""},
+		{[]byte{0xc3, 0xff, 0, 0, 20}, PacketTypeInitial},
+		{[]byte{0xd3, 0xff, 0, 0, 20}, PacketType0RTT},
+		{[]byte{0xe3, 0xff, 0, 0, 20}, PacketTypeHandshake},
+		{[]byte{0xf0, 0xff, 0, 0, 20}, PacketTypeRetry},
+		{[]byte{0xa5, 0, 0, 0, 0}, PacketTypeVersionNegotiation},
+	}
+	for _, tt := range tests {
+		typ := PacketType(tt.b)
+		if typ != tt.typ {
+			t.Errorf("unexpected packet type of %x: want %q, actual %q", tt.b, tt.typ, typ)
+		}
+	}
+	// DCIL = 8, SCIL = 5
+	b := []byte{0xc3, 0xff, 0, 0, 20, 0x52}
+	if n := packetSCIDLen(b); n != 5 {
+		t.Errorf("unexpected source connection id length: %d", n)
+	}
+	if n := packetSCIDLen(b[:1]); n != -1 {
+		t.Errorf("unexpected source connection id length: %d", n)
+	}
+}
+
+func TestQlogWriter(t *testing.T) {
+	var out bytes.Buffer
+	w, err := NewQlogWriter(&out, "server", []byte{0xab, 0xcd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	events := []TraceEvent{
+		{Type: TracePacketReceived, PacketType: PacketTypeInitial, PacketSize: 1200, DCID: []byte{0xab, 0xcd}},
+		{Type: TraceStreamOpened, StreamID: 4},
+		{Type: TraceHandshakeCompleted},
+		{Type: TraceStats, Stats: Stats{Recv: 2, Sent: 3, RTT: 1500 * time.Microsecond, CWnd: 14720}},
+		{Type: TraceConnectionClosed, Local: true, App: true, ErrorCode: 0, Reason: []byte("bye")},
+	}
+	for i := range events {
+		events[i].Time = now
+		w.TraceEvent(&events[i])
+	}
+	if err = w.Err(); err != nil {
+		t.Fatal(err)
+	}
+	var records []map[string]interface{}
+	s := bufio.NewScanner(&out)
+	for s.Scan() {
+		line := s.Bytes()
+		if len(line) == 0 || line[0] != qlogRecordSeparator {
+			t.Fatalf("missing record separator: %q", line)
+		}
+		var r map[string]interface{}
+		err = json.Unmarshal(line[1:], &r)
+		if err != nil {
+			t.Fatalf("invalid record %q: %v", line, err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != len(events)+1 {
+		t.Fatalf("unexpected number of records: %d", len(records))
+	}
+	if records[0]["qlog_format"] != qlogFormat {
+		t.Fatalf("unexpected header: %v", records[0])
+	}
+	trace := records[0]["trace"].(map[string]interface{})
+	common := trace["common_fields"].(map[string]interface{})
+	if common["ODCID"] != "abcd" {
+		t.Fatalf("unexpected common fields: %v", common)
+	}
+	names := []string{
+		"transport:packet_received",
+		"transport:stream_state_updated",
+		"connectivity:connection_state_updated",
+		"recovery:metrics_updated",
+		"connectivity:connection_closed",
+	}
+	for i, name := range names {
+		r := records[i+1]
+		if r["name"] != name {
+			t.Fatalf("unexpected event name: want %s, actual %v", name, r["name"])
+		}
+		if _, ok := r["time"].(float64); !ok {
+			t.Fatalf("missing event time: %v", r)
+		}
+	}
+	packet := records[1]["data"].(map[string]interface{})
+	header := packet["header"].(map[string]interface{})
+	if header["packet_type"] != PacketTypeInitial || header["dcid"] != "abcd" {
+		t.Fatalf("unexpected packet header: %v", header)
+	}
+	metrics := records[4]["data"].(map[string]interface{})
+	if metrics["smoothed_rtt"] != 1.5 || metrics["congestion_window"] != 14720.0 {
+		t.Fatalf("unexpected metrics: %v", metrics)
+	}
+	closed := records[5]["data"].(map[string]interface{})
+	if closed["application_code"] != 0.0 || closed["reason"] != "bye" {
+		t.Fatalf("unexpected connection closed: %v", closed)
+	}
+}
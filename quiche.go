@@ -16,6 +16,34 @@ static void debug_log(const char *line, void *argp) {
 static inline void log_to_stderr() {
 	quiche_enable_debug_logging(debug_log, NULL);
 }
+
+typedef struct {
+	int rc;
+	uint32_t version;
+	uint8_t type;
+	size_t scid_len;
+	size_t dcid_len;
+	size_t token_len;
+} header_info_result;
+
+// header_info returns the result by value to avoid Go pointers to local variables.
+static inline header_info_result header_info(const uint8_t *buf, size_t buf_len, size_t dcil,
+                                             uint8_t *scid, size_t scid_len,
+                                             uint8_t *dcid, size_t dcid_len,
+                                             uint8_t *token, size_t token_len) {
+	header_info_result r;
+	r.version = 0;
+	r.type = 0;
+	r.scid_len = scid_len;
+	r.dcid_len = dcid_len;
+	r.token_len = token_len;
+	r.rc = quiche_header_info(buf, buf_len, dcil,
+		&r.version, &r.type,
+		scid, &r.scid_len,
+		dcid, &r.dcid_len,
+		token, &r.token_len);
+	return r;
+}
 */
 import "C"
 import (
@@ -74,6 +102,22 @@ var errorDescriptions = map[Error]string{
 	ErrFinalSize:             "data exceeded stream's final size",
 }
 
+// errorValues are errors already converted to interface values, so that
+// returning them from the hot paths does not allocate.
+var errorValues = [...]error{
+	ErrDone, ErrBufferTooShort, ErrUnknownVersion, ErrInvalidFrame, ErrInvalidPacket,
+	ErrInvalidState, ErrInvalidStreamState, ErrInvalidTransportParam, ErrCryptoFail,
+	ErrTLSFail, ErrFlowControl, ErrStreamLimit, ErrFinalSize,
+}
+
+// toError converts a negative error code returned by quiche to an error.
+func toError(n int) error {
+	if i := -n - 1; i >= 0 && i < len(errorValues) {
+		return errorValues[i]
+	}
+	return Error(n)
+}
+
 // Header is a QUIC packet's header.
 type Header struct {
 	Type    uint8
@@ -86,28 +130,28 @@ type Header struct {
 // HeaderInfo extracts version, type, source / destination connection ID and address
 // verification token from the packet in b.
 func HeaderInfo(b []byte, dcidLength int, header *Header) error {
-	var ty C.uint8_t
-	var version C.uint32_t
-	scidLen := clen(header.SCID)
-	dcidLen := clen(header.DCID)
-	tokenLen := clen(header.Token)
-	n := C.quiche_header_info(cbytes(b), clen(b),
+	r := C.header_info(cbytes(b), clen(b),
 		C.size_t(dcidLength),
-		&version, &ty,
-		cbytes(header.SCID), &scidLen,
-		cbytes(header.DCID), &dcidLen,
-		cbytes(header.Token), &tokenLen)
-	if n < 0 {
-		if n == -1 {
+		cbytes(header.SCID), clen(header.SCID),
+		cbytes(header.DCID), clen(header.DCID),
+		cbytes(header.Token), clen(header.Token))
+	if r.rc < 0 {
+		if r.rc == -1 {
 			return ErrBufferTooShort
 		}
-		return Error(n)
+		return toError(int(r.rc))
+	}
+	// Lengths are never expected to exceed the buffers, but slicing beyond
+	// them would read memory the packet does not own.
+	if int(r.scid_len) > len(header.SCID) || int(r.dcid_len) > len(header.DCID) ||
+		int(r.token_len) > len(header.Token) {
+		return ErrBufferTooShort
 	}
-	header.Type = uint8(ty)
-	header.Version = uint32(version)
-	header.SCID = header.SCID[:scidLen]
-	header.DCID = header.DCID[:dcidLen]
-	header.Token = header.Token[:tokenLen]
+	header.Type = uint8(r._type)
+	header.Version = uint32(r.version)
+	header.SCID = header.SCID[:r.scid_len]
+	header.DCID = header.DCID[:r.dcid_len]
+	header.Token = header.Token[:r.token_len]
 	return nil
 }
 
@@ -117,7 +161,7 @@ func NegotiateVersion(scid, dcid, b []byte) (int, error) {
 		cbytes(dcid), clen(dcid),
 		cbytes(b), clen(b))
 	if n < 0 {
-		return 0, Error(n)
+		return 0, toError(int(n))
 	}
 	return int(n), nil
 }
@@ -130,7 +174,7 @@ func Retry(scid, dcid, newSCID, token, b []byte) (int, error) {
 		cbytes(token), clen(token),
 		cbytes(b), clen(b))
 	if n < 0 {
-		return 0, Error(n)
+		return 0, toError(int(n))
 	}
 	return int(n), nil
 }
@@ -3,10 +3,45 @@ package quiche
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
+
+	"github.com/goburrow/quiche/internal/certutil"
 )
 
+// Self-signed certificate generated by TestMain.
+var certFile, keyFile string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "quiche")
+	if err != nil {
+		panic(err)
+	}
+	certFile = filepath.Join(dir, "cert.crt")
+	keyFile = filepath.Join(dir, "cert.key")
+	err = writeTestCert(certFile, keyFile)
+	if err != nil {
+		os.RemoveAll(dir)
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func writeTestCert(certFile, keyFile string) error {
+	cert, err := certutil.Generate("quic.tech", 2*time.Hour)
+	if err != nil {
+		return err
+	}
+	return cert.WriteFiles(certFile, keyFile, false)
+}
+
 func randomCID() []byte {
 	b := make([]byte, 4)
 	_, err := rand.Read(b)
@@ -18,11 +53,11 @@ func randomCID() []byte {
 
 func defaultConfig() (*Config, error) {
 	config := NewConfig(ProtocolVersion)
-	err := config.LoadCertChainFromPEMFile("deps/quiche/examples/cert.crt")
+	err := config.LoadCertChainFromPEMFile(certFile)
 	if err != nil {
 		return nil, fmt.Errorf("load certificate: %v", err)
 	}
-	err = config.LoadPrivKeyFromPEMFile("deps/quiche/examples/cert.key")
+	err = config.LoadPrivKeyFromPEMFile(keyFile)
 	if err != nil {
 		return nil, fmt.Errorf("load private key: %v", err)
 	}
@@ -40,23 +75,52 @@ func defaultConfig() (*Config, error) {
 	return config, nil
 }
 
-func TestHandshake(t *testing.T) {
-	// EnableDebugLogging()
+// connPair is a client and a server connection sharing a config.
+type connPair struct {
+	config *Config
+	client *Connection
+	server *Connection
+}
+
+// newConnPair creates connections using defaultConfig, which is modified by
+// configure if it is not nil. The handshake is not started.
+func newConnPair(tb testing.TB, configure func(*Config)) *connPair {
+	tb.Helper()
 	config, err := defaultConfig()
 	if err != nil {
-		t.Fatal(err)
+		tb.Fatal(err)
 	}
-	defer config.Free()
-	client := Connect("", randomCID(), config)
-	defer client.Free()
-	server := Accept(randomCID(), nil, config)
-	defer server.Free()
+	if configure != nil {
+		configure(config)
+	}
+	return &connPair{
+		config: config,
+		client: Connect("", randomCID(), config),
+		server: Accept(randomCID(), nil, config),
+	}
+}
 
-	buf := make([]byte, 65535)
-	err = doHandshake(client, server, buf)
+// handshake establishes the connections.
+func (p *connPair) handshake(tb testing.TB) {
+	tb.Helper()
+	err := doHandshake(p.client, p.server, make([]byte, 65535))
 	if err != nil {
-		t.Fatal(err)
+		tb.Fatal(err)
 	}
+}
+
+func (p *connPair) free() {
+	p.server.Free()
+	p.client.Free()
+	p.config.Free()
+}
+
+func TestHandshake(t *testing.T) {
+	// EnableDebugLogging()
+	p := newConnPair(t, nil)
+	defer p.free()
+	p.handshake(t)
+	client, server := p.client, p.server
 	if !client.IsEstablished() || !server.IsEstablished() {
 		t.Fatalf("connection is not established: client=%v server=%v", client.IsEstablished(), server.IsEstablished())
 	}
@@ -86,6 +150,11 @@ func BenchmarkHandshake(b *testing.B) {
 	serverCID := randomCID()
 	buf := make([]byte, 65535)
 
+	var packets uint64
+	var stats Stats
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		client := Connect("", clientCID, config)
 		server := Accept(serverCID, nil, config)
@@ -93,9 +162,140 @@ func BenchmarkHandshake(b *testing.B) {
 		if err != nil {
 			b.Fatal(err)
 		}
+		client.Stats(&stats)
+		packets += stats.Sent
+		server.Stats(&stats)
+		packets += stats.Sent
 		server.Free()
 		client.Free()
 	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	if packets > 0 {
+		b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(packets), "allocs/packet")
+	}
+}
+
+func BenchmarkStreamTransfer(b *testing.B) {
+	config, err := defaultConfig()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer config.Free()
+	client := Connect("", randomCID(), config)
+	defer client.Free()
+	server := Accept(randomCID(), nil, config)
+	defer server.Free()
+
+	buffers := NewBufferPool(65535)
+	buf := buffers.Get()
+	defer buffers.Put(buf)
+	err = doHandshake(client, server, buf.B)
+	if err != nil {
+		b.Fatal(err)
+	}
+	rbuf := buffers.Get()
+	defer buffers.Put(rbuf)
+	data := []byte("0123456789")
+	const streamID = 4
+
+	var packets, received int
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = client.StreamSend(streamID, data, false)
+		if err != nil && err != ErrDone {
+			b.Fatal(err)
+		}
+		for {
+			n, err := pipe(client, server, buf.B)
+			if err != nil {
+				b.Fatal(err)
+			}
+			packets += n
+			for {
+				id, ok := server.ReadableNext()
+				if !ok {
+					break
+				}
+				n, _, err := server.StreamRecv(id, rbuf.B)
+				if err != nil {
+					b.Fatal(err)
+				}
+				received += n
+			}
+			m, err := pipe(server, client, buf.B)
+			if err != nil {
+				b.Fatal(err)
+			}
+			packets += m
+			if n == 0 && m == 0 {
+				break
+			}
+		}
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	allocs := float64(after.Mallocs - before.Mallocs)
+	if packets > 0 {
+		b.ReportMetric(allocs/float64(packets), "allocs/packet")
+	}
+	if received > 0 {
+		b.ReportMetric(allocs/float64(received), "allocs/byte")
+	}
+}
+
+func TestZeroAllocs(t *testing.T) {
+	p := newConnPair(t, func(config *Config) {
+		config.SetInitialMaxData(1 << 20)
+		config.SetInitialMaxStreamDataBidiLocal(1 << 20)
+		config.SetInitialMaxStreamDataBidiRemote(1 << 20)
+	})
+	defer p.free()
+	p.handshake(t)
+	client, server := p.client, p.server
+
+	buffers := NewBufferPool(65535)
+	data := []byte("0123456789")
+	const streamID = 4
+	allocs := testing.AllocsPerRun(100, func() {
+		buf := buffers.Get()
+		rbuf := buffers.Get()
+		defer buffers.Put(buf)
+		defer buffers.Put(rbuf)
+		_, err := client.StreamSend(streamID, data, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			n, err := pipe(client, server, buf.B)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for {
+				id, ok := server.ReadableNext()
+				if !ok {
+					break
+				}
+				_, _, err := server.StreamRecv(id, rbuf.B)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			m, err := pipe(server, client, buf.B)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n == 0 && m == 0 {
+				break
+			}
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("Recv, Send and StreamRecv must not allocate: %v allocs per run", allocs)
+	}
 }
 
 func doHandshake(client, server *Connection, buf []byte) error {
@@ -148,3 +348,151 @@ func connRecvSend(conn *Connection, b []byte, n int) (int, error) {
 	}
 	return off, nil
 }
+
+// pipe forwards packets one by one from src to dst until src has nothing to send.
+// It returns the number of packets forwarded.
+func pipe(src, dst *Connection, b []byte) (int, error) {
+	packets := 0
+	for {
+		n, err := src.Send(b)
+		if err == ErrDone {
+			return packets, nil
+		}
+		if err != nil {
+			return packets, err
+		}
+		_, err = dst.Recv(b[:n])
+		if err != nil && err != ErrDone {
+			return packets, err
+		}
+		packets++
+	}
+}
+
+func TestH3Request(t *testing.T) {
+	p := newConnPair(t, func(config *Config) {
+		err := config.SetApplicationProtos([]byte(H3ApplicationProtocol))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Control and QPACK streams need more credit than defaultConfig gives.
+		config.SetInitialMaxData(10000)
+		config.SetInitialMaxStreamDataBidiLocal(1000)
+		config.SetInitialMaxStreamDataBidiRemote(1000)
+		config.SetInitialMaxStreamDataUni(1000)
+		config.SetInitialMaxStreamsBidi(10)
+		config.SetInitialMaxStreamsUni(10)
+	})
+	defer p.free()
+	p.handshake(t)
+	client, server := p.client, p.server
+	h3config := NewH3Config(0, 1024, 0, 0)
+	defer h3config.Free()
+	buf := make([]byte, 65535)
+	clientH3 := H3Connect(client, h3config)
+	if clientH3 == nil {
+		t.Fatal("could not create client HTTP/3 connection")
+	}
+	defer clientH3.Free()
+	serverH3 := H3Accept(server, h3config)
+	if serverH3 == nil {
+		t.Fatal("could not create server HTTP/3 connection")
+	}
+	defer serverH3.Free()
+
+	req := []H3Header{
+		{Name: []byte(":method"), Value: []byte("GET")},
+		{Name: []byte(":scheme"), Value: []byte("https")},
+		{Name: []byte(":authority"), Value: []byte("quic.tech")},
+		{Name: []byte(":path"), Value: []byte("/index.html")},
+	}
+	streamID, err := clientH3.SendRequest(client, req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, client, server)
+
+	var path string
+	finished := false
+	for {
+		id, ev, err := serverH3.Poll(server)
+		if err == ErrDone {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != streamID {
+			t.Fatalf("unexpected request stream: want %d, actual %d", streamID, id)
+		}
+		switch ev.Type() {
+		case H3EventHeaders:
+			for _, h := range ev.Headers() {
+				if string(h.Name) == ":path" {
+					path = string(h.Value)
+				}
+			}
+		case H3EventFinished:
+			finished = true
+		}
+		ev.Free()
+	}
+	if path != "/index.html" || !finished {
+		t.Fatalf("unexpected request: path=%q finished=%v", path, finished)
+	}
+
+	body := []byte("hello")
+	resp := []H3Header{
+		{Name: []byte(":status"), Value: []byte("200")},
+	}
+	err = serverH3.SendResponse(server, streamID, resp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := serverH3.SendBody(server, streamID, body, true)
+	if err != nil || n != len(body) {
+		t.Fatalf("unexpected sent body: n=%d err=%v", n, err)
+	}
+	exchange(t, client, server)
+
+	var status string
+	var received []byte
+	finished = false
+	for {
+		id, ev, err := clientH3.Poll(client)
+		if err == ErrDone {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != streamID {
+			t.Fatalf("unexpected response stream: want %d, actual %d", streamID, id)
+		}
+		switch ev.Type() {
+		case H3EventHeaders:
+			for _, h := range ev.Headers() {
+				if string(h.Name) == ":status" {
+					status = string(h.Value)
+				}
+			}
+		case H3EventData:
+			for {
+				n, err := clientH3.RecvBody(client, id, buf)
+				if err == ErrDone {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				received = append(received, buf[:n]...)
+			}
+		case H3EventFinished:
+			finished = true
+		}
+		ev.Free()
+	}
+	if status != "200" || string(received) != string(body) || !finished {
+		t.Fatalf("unexpected response: status=%q body=%q finished=%v", status, received, finished)
+	}
+}
@@ -0,0 +1,186 @@
+package quiche
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+)
+
+// StatsSample is the statistics of a connection at a point in time.
+type StatsSample struct {
+	Time  time.Time
+	Stats Stats
+}
+
+// StatsRing keeps the most recent samples.
+type StatsRing struct {
+	samples []StatsSample
+	next    int
+	full    bool
+}
+
+// NewStatsRing creates a ring buffer of n samples.
+func NewStatsRing(n int) *StatsRing {
+	if n < 1 {
+		n = 1
+	}
+	return &StatsRing{
+		samples: make([]StatsSample, n),
+	}
+}
+
+// Add adds the sample, replacing the oldest one if the ring is full.
+func (r *StatsRing) Add(s *StatsSample) {
+	r.samples[r.next] = *s
+	r.next++
+	if r.next == len(r.samples) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// Len returns the number of samples in the ring.
+func (r *StatsRing) Len() int {
+	if r.full {
+		return len(r.samples)
+	}
+	return r.next
+}
+
+// Samples returns a copy of the samples from the oldest to the newest.
+func (r *StatsRing) Samples() []StatsSample {
+	if !r.full {
+		return append([]StatsSample(nil), r.samples[:r.next]...)
+	}
+	s := make([]StatsSample, 0, len(r.samples))
+	s = append(s, r.samples[r.next:]...)
+	return append(s, r.samples[:r.next]...)
+}
+
+// StatsSampler takes samples of connection statistics at an interval.
+// It does not start any goroutine: the event loop owning the connection
+// calls Poll and should wake up no later than Deadline.
+type StatsSampler struct {
+	interval time.Duration
+	ring     *StatsRing
+	onSample func(s *StatsSample)
+	next     time.Time
+}
+
+// NewStatsSampler creates a sampler keeping the last n samples taken every
+// interval. onSample is called with each sample if it is not nil.
+func NewStatsSampler(interval time.Duration, n int, onSample func(s *StatsSample)) *StatsSampler {
+	return &StatsSampler{
+		interval: interval,
+		ring:     NewStatsRing(n),
+		onSample: onSample,
+	}
+}
+
+// Deadline returns the time of the next sample. It is zero before the first
+// sample is taken.
+func (s *StatsSampler) Deadline() time.Time {
+	return s.next
+}
+
+// Due returns true if a sample should be taken at now.
+func (s *StatsSampler) Due(now time.Time) bool {
+	return !now.Before(s.next)
+}
+
+// Poll samples statistics of conn if it is due.
+func (s *StatsSampler) Poll(conn *Connection, now time.Time) {
+	if s.Due(now) {
+		s.Sample(conn, now)
+	}
+}
+
+// Sample samples statistics of conn regardless of the interval, e.g. when
+// the connection is closed.
+func (s *StatsSampler) Sample(conn *Connection, now time.Time) {
+	var stats Stats
+	conn.Stats(&stats)
+	s.Add(now, &stats)
+}
+
+// Add records the statistics taken at now and schedules the next sample.
+func (s *StatsSampler) Add(now time.Time, stats *Stats) {
+	sample := StatsSample{
+		Time:  now,
+		Stats: *stats,
+	}
+	s.ring.Add(&sample)
+	s.next = now.Add(s.interval)
+	if s.onSample != nil {
+		s.onSample(&sample)
+	}
+}
+
+// Samples returns the kept samples from the oldest to the newest.
+func (s *StatsSampler) Samples() []StatsSample {
+	return s.ring.Samples()
+}
+
+var statsColumns = []string{"time", "elapsed_ms", "recv", "sent", "lost", "rtt_ms", "cwnd"}
+
+// WriteStatsCSV writes the samples with a header row in CSV format. Elapsed
+// time is relative to the first sample.
+func WriteStatsCSV(w io.Writer, samples []StatsSample) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(statsColumns)
+	if err != nil {
+		return err
+	}
+	record := make([]string, len(statsColumns))
+	for i := range samples {
+		s := &samples[i]
+		record[0] = s.Time.Format(time.RFC3339Nano)
+		record[1] = formatMillis(s.Time.Sub(samples[0].Time))
+		record[2] = strconv.FormatUint(s.Stats.Recv, 10)
+		record[3] = strconv.FormatUint(s.Stats.Sent, 10)
+		record[4] = strconv.FormatUint(s.Stats.Lost, 10)
+		record[5] = formatMillis(s.Stats.RTT)
+		record[6] = strconv.FormatUint(s.Stats.CWnd, 10)
+		err = cw.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+type statsSampleJSON struct {
+	Time    time.Time `json:"time"`
+	Elapsed float64   `json:"elapsed_ms"`
+	Recv    uint64    `json:"recv"`
+	Sent    uint64    `json:"sent"`
+	Lost    uint64    `json:"lost"`
+	RTT     float64   `json:"rtt_ms"`
+	CWnd    uint64    `json:"cwnd"`
+}
+
+// WriteStatsJSON writes the samples as a JSON array with the same fields as
+// WriteStatsCSV.
+func WriteStatsJSON(w io.Writer, samples []StatsSample) error {
+	v := make([]statsSampleJSON, len(samples))
+	for i := range samples {
+		s := &samples[i]
+		v[i] = statsSampleJSON{
+			Time:    s.Time,
+			Elapsed: durationMillis(s.Time.Sub(samples[0].Time)),
+			Recv:    s.Stats.Recv,
+			Sent:    s.Stats.Sent,
+			Lost:    s.Stats.Lost,
+			RTT:     durationMillis(s.Stats.RTT),
+			CWnd:    s.Stats.CWnd,
+		}
+	}
+	return json.NewEncoder(w).Encode(v)
+}
+
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(durationMillis(d), 'f', -1, 64)
+}
@@ -0,0 +1,78 @@
+package quiche
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsRing(t *testing.T) {
+	r := NewStatsRing(3)
+	if r.Len() != 0 || len(r.Samples()) != 0 {
+		t.Fatalf("unexpected samples: %v", r.Samples())
+	}
+	for i := 1; i <= 5; i++ {
+		r.Add(&StatsSample{Stats: Stats{Sent: uint64(i)}})
+		want := i
+		if want > 3 {
+			want = 3
+		}
+		if r.Len() != want {
+			t.Fatalf("unexpected length: want %d, actual %d", want, r.Len())
+		}
+	}
+	samples := r.Samples()
+	for i, s := range samples {
+		if s.Stats.Sent != uint64(i+3) {
+			t.Fatalf("unexpected samples: %v", samples)
+		}
+	}
+}
+
+func TestStatsSampler(t *testing.T) {
+	var called int
+	s := NewStatsSampler(time.Second, 10, func(*StatsSample) {
+		called++
+	})
+	now := time.Unix(1500000000, 0)
+	if !s.Due(now) {
+		t.Fatal("first sample must be due")
+	}
+	s.Add(now, &Stats{Sent: 1, RTT: 10 * time.Millisecond})
+	if s.Due(now.Add(999*time.Millisecond)) || !s.Due(now.Add(time.Second)) {
+		t.Fatalf("unexpected deadline: %v", s.Deadline())
+	}
+	s.Add(now.Add(1500*time.Millisecond), &Stats{Sent: 5, Lost: 1, RTT: 12500 * time.Microsecond, CWnd: 14720})
+	if called != 2 || len(s.Samples()) != 2 {
+		t.Fatalf("unexpected samples: called %d, %v", called, s.Samples())
+	}
+
+	var b bytes.Buffer
+	err := WriteStatsCSV(&b, s.Samples())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 || lines[0] != "time,elapsed_ms,recv,sent,lost,rtt_ms,cwnd" {
+		t.Fatalf("unexpected csv:\n%s", b.String())
+	}
+	if !strings.HasSuffix(lines[2], ",1500,0,5,1,12.5,14720") {
+		t.Fatalf("unexpected csv record: %s", lines[2])
+	}
+
+	b.Reset()
+	err = WriteStatsJSON(&b, s.Samples())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v []map[string]interface{}
+	err = json.Unmarshal(b.Bytes(), &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 2 || v[1]["elapsed_ms"] != 1500.0 || v[1]["rtt_ms"] != 12.5 || v[1]["cwnd"] != 14720.0 {
+		t.Fatalf("unexpected json: %s", b.String())
+	}
+}
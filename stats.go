@@ -0,0 +1,90 @@
+package quiche
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ConnectionStats extends Stats with statistics kept by TracedConnection.
+type ConnectionStats struct {
+	Stats
+
+	BytesRecv       uint64 // The number of UDP payload bytes received.
+	BytesSent       uint64 // The number of UDP payload bytes sent.
+	StreamBytesRecv uint64 // The number of stream data bytes read.
+	StreamBytesSent uint64 // The number of stream data bytes written.
+	Timeouts        uint64 // The number of timeouts processed.
+
+	// HandshakeDuration is zero until the connection is established.
+	HandshakeDuration time.Duration
+	// TimeToFirstByte is the time until stream data is first read, or zero.
+	TimeToFirstByte time.Duration
+	MinRTT          time.Duration // The minimum RTT estimate observed.
+	SmoothedRTT     time.Duration // The current RTT estimate, same as RTT.
+
+	// Streams are statistics of each stream if requested.
+	Streams map[uint64]StreamStats
+}
+
+// StreamStats is statistics about a stream.
+type StreamStats struct {
+	Recv uint64 `json:"recv"` // The number of bytes read from the stream.
+	Sent uint64 `json:"sent"` // The number of bytes written to the stream.
+}
+
+func (s *ConnectionStats) String() string {
+	return fmt.Sprintf("%v bytes_recv=%d bytes_sent=%d stream_recv=%d stream_sent=%d timeouts=%d handshake=%s ttfb=%s min_rtt=%s",
+		&s.Stats, s.BytesRecv, s.BytesSent, s.StreamBytesRecv, s.StreamBytesSent, s.Timeouts,
+		s.HandshakeDuration, s.TimeToFirstByte, s.MinRTT)
+}
+
+type connectionStatsJSON struct {
+	PacketsRecv       uint64                 `json:"packets_recv"`
+	PacketsSent       uint64                 `json:"packets_sent"`
+	PacketsLost       uint64                 `json:"packets_lost"`
+	CWnd              uint64                 `json:"cwnd"`
+	BytesRecv         uint64                 `json:"bytes_recv"`
+	BytesSent         uint64                 `json:"bytes_sent"`
+	StreamBytesRecv   uint64                 `json:"stream_bytes_recv"`
+	StreamBytesSent   uint64                 `json:"stream_bytes_sent"`
+	Timeouts          uint64                 `json:"timeouts"`
+	HandshakeDuration float64                `json:"handshake_ms"`
+	TimeToFirstByte   float64                `json:"ttfb_ms"`
+	MinRTT            float64                `json:"min_rtt_ms"`
+	SmoothedRTT       float64                `json:"smoothed_rtt_ms"`
+	Streams           map[string]StreamStats `json:"streams,omitempty"`
+}
+
+// MarshalJSON encodes the statistics as a JSON object with snake case keys.
+// Durations are in milliseconds.
+func (s ConnectionStats) MarshalJSON() ([]byte, error) {
+	v := connectionStatsJSON{
+		PacketsRecv:       s.Recv,
+		PacketsSent:       s.Sent,
+		PacketsLost:       s.Lost,
+		CWnd:              s.CWnd,
+		BytesRecv:         s.BytesRecv,
+		BytesSent:         s.BytesSent,
+		StreamBytesRecv:   s.StreamBytesRecv,
+		StreamBytesSent:   s.StreamBytesSent,
+		Timeouts:          s.Timeouts,
+		HandshakeDuration: durationMillis(s.HandshakeDuration),
+		TimeToFirstByte:   durationMillis(s.TimeToFirstByte),
+		MinRTT:            durationMillis(s.MinRTT),
+		SmoothedRTT:       durationMillis(s.SmoothedRTT),
+	}
+	if len(s.Streams) > 0 {
+		v.Streams = make(map[string]StreamStats, len(s.Streams))
+		for id, st := range s.Streams {
+			v.Streams[strconv.FormatUint(id, 10)] = st
+		}
+	}
+	return json.Marshal(&v)
+}
+
+// durationMillis returns d in milliseconds.
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
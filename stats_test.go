@@ -0,0 +1,64 @@
+package quiche
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionStatsJSON(t *testing.T) {
+	s := ConnectionStats{
+		Stats: Stats{
+			Recv: 10,
+			Sent: 12,
+			Lost: 1,
+			RTT:  25 * time.Millisecond,
+			CWnd: 14720,
+		},
+		BytesRecv:         12000,
+		BytesSent:         3000,
+		StreamBytesRecv:   10000,
+		Timeouts:          2,
+		HandshakeDuration: 50 * time.Millisecond,
+		TimeToFirstByte:   75500 * time.Microsecond,
+		MinRTT:            20 * time.Millisecond,
+		SmoothedRTT:       25 * time.Millisecond,
+		Streams: map[uint64]StreamStats{
+			4: {Recv: 10000, Sent: 20},
+		},
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]interface{}
+	err = json.Unmarshal(b, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"packets_recv":    10,
+		"packets_lost":    1,
+		"cwnd":            14720,
+		"bytes_recv":      12000,
+		"timeouts":        2,
+		"handshake_ms":    50,
+		"ttfb_ms":         75.5,
+		"min_rtt_ms":      20,
+		"smoothed_rtt_ms": 25,
+	}
+	for k, n := range want {
+		if v[k] != n {
+			t.Errorf("unexpected %s: want %v, actual %v", k, n, v[k])
+		}
+	}
+	streams := v["streams"].(map[string]interface{})
+	st := streams["4"].(map[string]interface{})
+	if st["recv"] != 10000.0 || st["sent"] != 20.0 {
+		t.Errorf("unexpected stream stats: %v", st)
+	}
+	if str := s.String(); !strings.Contains(str, "cwnd=14720") || !strings.Contains(str, "ttfb=75.5ms") {
+		t.Errorf("unexpected string: %s", str)
+	}
+}
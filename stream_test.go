@@ -0,0 +1,520 @@
+package quiche
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// streamData is data read from a stream.
+type streamData struct {
+	b   []byte
+	fin bool
+}
+
+// newStreamPair returns established connections using defaultConfig, whose
+// limits are 30 bytes per connection, 15 bytes per bidirectional stream,
+// 10 bytes per unidirectional stream and 3 streams of each type.
+func newStreamPair(t *testing.T) *connPair {
+	p := newConnPair(t, nil)
+	p.handshake(t)
+	return p
+}
+
+// exchange forwards packets in both directions until there is nothing to send.
+func exchange(t *testing.T, client, server *Connection) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := pipe(client, server, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := pipe(server, client, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 && m == 0 {
+			return
+		}
+	}
+}
+
+// readStreams reads all readable streams of the connection into data.
+func readStreams(t *testing.T, conn *Connection, data map[uint64]*streamData) {
+	buf := make([]byte, 100)
+	for {
+		id, ok := conn.ReadableNext()
+		if !ok {
+			return
+		}
+		n, fin, err := conn.StreamRecv(id, buf)
+		if err != nil && err != ErrDone {
+			t.Fatalf("stream %d: %v", id, err)
+		}
+		d := data[id]
+		if d == nil {
+			d = &streamData{}
+			data[id] = d
+		}
+		d.b = append(d.b, buf[:n]...)
+		d.fin = d.fin || fin
+	}
+}
+
+func TestStreamBidi(t *testing.T) {
+	p := newStreamPair(t)
+	defer p.free()
+	client, server := p.client, p.server
+
+	const streamID = 0
+	_, err := client.StreamSend(streamID, []byte("hello"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, client, server)
+	data := make(map[uint64]*streamData)
+	readStreams(t, server, data)
+	if d := data[streamID]; d == nil || string(d.b) != "hello" || !d.fin {
+		t.Fatalf("unexpected server data: %+v", data)
+	}
+	if !server.StreamFinished(streamID) {
+		t.Fatal("server stream must be finished")
+	}
+	if client.StreamFinished(streamID) {
+		t.Fatal("client stream must not be finished")
+	}
+
+	_, err = server.StreamSend(streamID, []byte("world"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, client, server)
+	data = make(map[uint64]*streamData)
+	readStreams(t, client, data)
+	if d := data[streamID]; d == nil || string(d.b) != "world" || !d.fin {
+		t.Fatalf("unexpected client data: %+v", data)
+	}
+	if !client.StreamFinished(streamID) {
+		t.Fatal("client stream must be finished")
+	}
+	if _, ok := client.ReadableNext(); ok {
+		t.Fatal("no stream must be readable")
+	}
+}
+
+func TestStreamUni(t *testing.T) {
+	p := newStreamPair(t)
+	defer p.free()
+	client, server := p.client, p.server
+
+	// Client-initiated unidirectional stream.
+	const streamID = 2
+	_, err := client.StreamSend(streamID, []byte("0123456789"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, client, server)
+	data := make(map[uint64]*streamData)
+	readStreams(t, server, data)
+	if d := data[streamID]; d == nil || string(d.b) != "0123456789" || !d.fin {
+		t.Fatalf("unexpected server data: %+v", data)
+	}
+	if !server.StreamFinished(streamID) {
+		t.Fatal("server stream must be finished")
+	}
+	// The server can not write to the peer's unidirectional stream.
+	_, err = server.StreamSend(streamID, []byte("x"), false)
+	if !errors.Is(err, ErrInvalidStreamState) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	p := newStreamPair(t)
+	defer p.free()
+	client, server := p.client, p.server
+
+	payload := []byte("0123456789abcdefghij")
+	pending := map[uint64][]byte{0: payload, 4: payload, 8: payload}
+	send := func() {
+		for id, b := range pending {
+			n, err := client.StreamSend(id, b, true)
+			if err != nil && err != ErrDone {
+				t.Fatalf("stream %d: %v", id, err)
+			}
+			if n == len(b) {
+				delete(pending, id)
+			} else {
+				pending[id] = b[n:]
+			}
+		}
+	}
+	send()
+	// Locally, data beyond the credit is not written instead of failing
+	// with ErrFlowControl.
+	if len(pending) == 0 {
+		t.Fatal("data must be blocked by flow control")
+	}
+	exchange(t, client, server)
+	data := make(map[uint64]*streamData)
+	readStreams(t, server, data)
+	total := 0
+	for id, d := range data {
+		if len(d.b) > 15 || d.fin {
+			t.Fatalf("stream %d exceeded stream limit: %d bytes, fin=%v", id, len(d.b), d.fin)
+		}
+		total += len(d.b)
+	}
+	if total == 0 || total > 30 {
+		t.Fatalf("unexpected received bytes within connection limit: %d", total)
+	}
+
+	// Reading data gives credit back to the client.
+	for i := 0; i < 10; i++ {
+		send()
+		exchange(t, client, server)
+		readStreams(t, server, data)
+	}
+	if len(pending) > 0 {
+		t.Fatalf("data is not sent: %q", pending)
+	}
+	for _, id := range []uint64{0, 4, 8} {
+		d := data[id]
+		if d == nil || string(d.b) != string(payload) || !d.fin {
+			t.Fatalf("stream %d: unexpected data: %+v", id, d)
+		}
+	}
+}
+
+// TestStreamFlowControlViolation forges a packet from the client with more
+// data than the stream credit, as the library never exceeds the limits of
+// the peer.
+func TestStreamFlowControlViolation(t *testing.T) {
+	keys := &syncBuffer{}
+	p := newConnPair(t, func(config *Config) {
+		err := config.LogKeysTo(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer p.free()
+	p.handshake(t)
+	client, server := p.client, p.server
+
+	// The connection ID of the server is taken from a packet of the client,
+	// which is not delivered.
+	_, err := client.StreamSend(0, []byte("a"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65535)
+	n, err := client.Send(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcid, err := PacketDCID(buf[:n], len(randomCID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcid = append([]byte(nil), dcid...)
+
+	// STREAM frame with length: stream 0, 20 bytes while the server only
+	// allows 15 bytes per stream.
+	frame := append([]byte{0x0a, 0x00, 20}, "0123456789abcdefghij"...)
+	packet := sealShortPacket(t, clientTrafficSecret(t, keys), dcid, 1<<20, frame)
+	_, err = server.Recv(packet)
+	if !errors.Is(err, ErrFlowControl) {
+		t.Fatalf("expect %v, actual %v", ErrFlowControl, err)
+	}
+	if !IsFatal(err) {
+		t.Fatalf("flow control error must be fatal: %v", err)
+	}
+	var opErr *OpError
+	if !errors.As(err, &opErr) || opErr.Op != OpRecv {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
+
+func TestStreamLimit(t *testing.T) {
+	p := newStreamPair(t)
+	defer p.free()
+	client := p.client
+
+	for _, id := range []uint64{0, 4, 8, 2, 6, 10} {
+		_, err := client.StreamSend(id, []byte("a"), false)
+		if err != nil {
+			t.Fatalf("stream %d: %v", id, err)
+		}
+	}
+	// The fourth stream of each type.
+	for _, id := range []uint64{12, 14} {
+		_, err := client.StreamSend(id, []byte("a"), false)
+		if !errors.Is(err, ErrStreamLimit) {
+			t.Fatalf("stream %d: unexpected error: %v", id, err)
+		}
+		var opErr *OpError
+		if !errors.As(err, &opErr) || opErr.Op != OpStreamSend || opErr.StreamID != id {
+			t.Fatalf("stream %d: unexpected operation error: %#v", id, opErr)
+		}
+	}
+}
+
+func TestStreamFin(t *testing.T) {
+	p := newStreamPair(t)
+	defer p.free()
+	client, server := p.client, p.server
+
+	const streamID = 4
+	_, err := client.StreamSend(streamID, []byte("abcdef"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The final size can not be changed.
+	_, err = client.StreamSend(streamID, []byte("g"), false)
+	if !errors.Is(err, ErrFinalSize) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exchange(t, client, server)
+
+	// FIN is only reported with the last part of data.
+	buf := make([]byte, 4)
+	n, fin, err := server.StreamRecv(streamID, buf)
+	if err != nil || n != 4 || fin {
+		t.Fatalf("unexpected read: n=%d fin=%v err=%v", n, fin, err)
+	}
+	if server.StreamFinished(streamID) {
+		t.Fatal("stream must not be finished before reading all data")
+	}
+	n, fin, err = server.StreamRecv(streamID, buf)
+	if err != nil || string(buf[:n]) != "ef" || !fin {
+		t.Fatalf("unexpected read: %q fin=%v err=%v", buf[:n], fin, err)
+	}
+	if !server.StreamFinished(streamID) {
+		t.Fatal("stream must be finished")
+	}
+	_, _, err = server.StreamRecv(streamID, buf)
+	if err == nil || IsFatal(err) {
+		t.Fatalf("unexpected error reading finished stream: %v", err)
+	}
+}
+
+func TestStreamInvalidState(t *testing.T) {
+	p := newStreamPair(t)
+	defer p.free()
+	client, server := p.client, p.server
+
+	buf := make([]byte, 10)
+	// Stream has not been created.
+	_, _, err := server.StreamRecv(8, buf)
+	if !errors.Is(err, ErrInvalidStreamState) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if IsFatal(err) || IsTemporary(err) {
+		t.Fatalf("invalid stream state must be neither fatal nor temporary: %v", err)
+	}
+	err = server.StreamShutdown(8, ShutdownRead, 0)
+	if !errors.Is(err, ErrInvalidStreamState) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Server-initiated unidirectional stream.
+	_, err = client.StreamSend(3, []byte("a"), false)
+	if !errors.Is(err, ErrInvalidStreamState) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestStreamShutdown(t *testing.T) {
+	p := newStreamPair(t)
+	defer p.free()
+	client, server := p.client, p.server
+
+	const streamID = 0
+	_, err := client.StreamSend(streamID, []byte("abc"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, client, server)
+	id, ok := server.ReadableNext()
+	if !ok || id != streamID {
+		t.Fatalf("stream must be readable: %d %v", id, ok)
+	}
+	// Buffered data is discarded when reading is shut down.
+	err = server.StreamShutdown(streamID, ShutdownRead, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.StreamSend(streamID, []byte("def"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, client, server)
+	data := make(map[uint64]*streamData)
+	readStreams(t, server, data)
+	if d := data[streamID]; d != nil && len(d.b) > 0 {
+		t.Fatalf("unexpected data after shutdown: %q", d.b)
+	}
+
+	// Writing side.
+	_, err = server.StreamSend(streamID, []byte("xyz"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.StreamShutdown(streamID, ShutdownWrite, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, client, server)
+	// Unsent data is discarded and the stream is not finished.
+	if id, ok := client.ReadableNext(); ok {
+		t.Fatalf("stream %d must not be readable after reset", id)
+	}
+	buf := make([]byte, 10)
+	n, fin, err := client.StreamRecv(streamID, buf)
+	if err != ErrDone || n != 0 || fin {
+		t.Fatalf("unexpected receive after reset: n=%d fin=%v err=%v data=%q", n, fin, err, buf[:n])
+	}
+	if client.StreamFinished(streamID) {
+		t.Fatal("reset stream must not be finished")
+	}
+	if client.IsClosed() || server.IsClosed() {
+		t.Fatal("resetting a stream must not close the connection")
+	}
+}
+
+func TestStreamAfterClose(t *testing.T) {
+	p := newStreamPair(t)
+	defer p.free()
+	client, server := p.client, p.server
+
+	err := client.CloseApplication(0x10, "bye")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeErr := client.CloseError()
+	if closeErr == nil || closeErr.Remote || !closeErr.App || closeErr.Code != 0x10 || closeErr.Reason != "bye" {
+		t.Fatalf("unexpected close error: %+v", closeErr)
+	}
+	// Both connections are closed after draining.
+	for i := 0; i < 100 && !(client.IsClosed() && server.IsClosed()); i++ {
+		exchange(t, client, server)
+		for _, c := range []*Connection{client, server} {
+			if d := c.Timeout(); d >= 0 && !c.IsClosed() {
+				time.Sleep(d)
+				c.OnTimeout()
+			}
+		}
+	}
+	if !client.IsClosed() || !server.IsClosed() {
+		t.Fatalf("connections must be closed: client=%v server=%v", client.IsClosed(), server.IsClosed())
+	}
+	_, err = client.StreamSend(0, []byte("a"), false)
+	if !errors.As(err, &closeErr) || closeErr.Remote || closeErr.Code != 0x10 {
+		t.Fatalf("unexpected client error: %v", err)
+	}
+	_, err = server.StreamSend(1, []byte("a"), false)
+	if !errors.As(err, &closeErr) || !closeErr.Remote || !IsFatal(err) {
+		t.Fatalf("unexpected server error: %v", err)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(b)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+// clientTrafficSecret waits for the client 1-RTT secret in the key log.
+func clientTrafficSecret(t *testing.T, keys *syncBuffer) []byte {
+	deadline := time.Now().Add(time.Second)
+	for {
+		for _, line := range strings.Split(keys.String(), "\n") {
+			f := strings.Fields(line)
+			if len(f) == 3 && f[0] == "CLIENT_TRAFFIC_SECRET_0" {
+				secret, err := hex.DecodeString(f[2])
+				if err != nil {
+					t.Fatal(err)
+				}
+				return secret
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("client traffic secret is not logged: %q", keys.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sealShortPacket protects payload in a short header packet using the
+// AES-128-GCM keys derived from the traffic secret as in draft-ietf-quic-tls-20,
+// which is the cipher suite negotiated on hardware with AES support.
+func sealShortPacket(t *testing.T, secret, dcid []byte, pn uint32, payload []byte) []byte {
+	if len(secret) != sha256.Size {
+		t.Fatalf("unsupported secret length: %d", len(secret))
+	}
+	key := hkdfExpandLabel(secret, "quic key", 16)
+	iv := hkdfExpandLabel(secret, "quic iv", 12)
+	hp := hkdfExpandLabel(secret, "quic hp", 16)
+
+	// Fixed bit and 4-byte packet number.
+	hdr := append([]byte{0x43}, dcid...)
+	hdr = append(hdr, byte(pn>>24), byte(pn>>16), byte(pn>>8), byte(pn))
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < 4; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	packet := aead.Seal(append([]byte(nil), hdr...), nonce, payload, hdr)
+
+	// Header protection samples 16 bytes after the packet number.
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pnOffset := len(hdr) - 4
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, packet[pnOffset+4:])
+	packet[0] ^= mask[0] & 0x1f
+	for i := 0; i < 4; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 with SHA-256 and an empty
+// context for length up to the hash size.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0, 1)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(info)
+	return mac.Sum(nil)[:length]
+}
@@ -0,0 +1,458 @@
+package quiche
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// TraceEventType is the type of a traced connection event.
+type TraceEventType int
+
+const (
+	TracePacketReceived     TraceEventType = iota // A packet is received from the peer.
+	TracePacketSent                               // A packet is written to be sent to the peer.
+	TraceStreamOpened                             // Stream data is first sent or received.
+	TraceStreamClosed                             // All stream data has been sent and received.
+	TraceTimeout                                  // The connection timer has expired.
+	TraceHandshakeCompleted                       // The handshake is complete.
+	TraceConnectionClosed                         // The connection is closed.
+	TraceStats                                    // A sample of the connection statistics.
+)
+
+var traceEventTypeNames = [...]string{
+	TracePacketReceived:     "packet_received",
+	TracePacketSent:         "packet_sent",
+	TraceStreamOpened:       "stream_opened",
+	TraceStreamClosed:       "stream_closed",
+	TraceTimeout:            "timeout",
+	TraceHandshakeCompleted: "handshake_completed",
+	TraceConnectionClosed:   "connection_closed",
+	TraceStats:              "stats",
+}
+
+func (t TraceEventType) String() string {
+	if t >= 0 && int(t) < len(traceEventTypeNames) {
+		return traceEventTypeNames[t]
+	}
+	return "unknown"
+}
+
+// Packet types of traced packets.
+const (
+	PacketTypeInitial            = "initial"
+	PacketType0RTT               = "0RTT"
+	PacketTypeHandshake          = "handshake"
+	PacketTypeRetry              = "retry"
+	PacketTypeVersionNegotiation = "version_negotiation"
+	PacketType1RTT               = "1RTT"
+)
+
+// TraceEvent is an event of a connection. Only the fields relevant to the
+// event type are set.
+type TraceEvent struct {
+	Time time.Time
+	Type TraceEventType
+
+	// Packet events. DCID refers to the packet buffer.
+	PacketType string
+	PacketSize int
+	DCID       []byte
+
+	// Stream events.
+	StreamID uint64
+
+	// Connection closed event. Local is false when the connection was
+	// closed by the peer or timed out, in which case the error is unknown.
+	Local     bool
+	App       bool
+	ErrorCode uint16
+	Reason    []byte
+
+	// Stats event.
+	Stats Stats
+}
+
+// Tracer receives connection events. The event and the slices it refers to
+// are only valid during the call.
+type Tracer interface {
+	TraceEvent(e *TraceEvent)
+}
+
+type multiTracer []Tracer
+
+func (t multiTracer) TraceEvent(e *TraceEvent) {
+	for _, tracer := range t {
+		tracer.TraceEvent(e)
+	}
+}
+
+// MultiTracer returns a tracer which passes events to all the given non-nil
+// tracers, or nil if there are none.
+func MultiTracer(tracers ...Tracer) Tracer {
+	var t multiTracer
+	for _, tracer := range tracers {
+		if tracer != nil {
+			t = append(t, tracer)
+		}
+	}
+	switch len(t) {
+	case 0:
+		return nil
+	case 1:
+		return t[0]
+	}
+	return t
+}
+
+// PacketType returns the type of the QUIC packet in b as used in traces,
+// or an empty string if b is too short.
+func PacketType(b []byte) string {
+	if len(b) < 1 {
+		return ""
+	}
+	if b[0]&0x80 == 0 {
+		return PacketType1RTT
+	}
+	if len(b) < 5 {
+		return ""
+	}
+	if binary.BigEndian.Uint32(b[1:5]) == 0 {
+		return PacketTypeVersionNegotiation
+	}
+	switch (b[0] & 0x30) >> 4 {
+	case 0:
+		return PacketTypeInitial
+	case 1:
+		return PacketType0RTT
+	case 2:
+		return PacketTypeHandshake
+	default:
+		return PacketTypeRetry
+	}
+}
+
+// packetSCIDLen returns the source connection ID length of a long header
+// packet, or -1 for short header packets.
+func packetSCIDLen(b []byte) int {
+	if len(b) < 6 || b[0]&0x80 == 0 {
+		return -1
+	}
+	scil := int(b[5] & 0x0f)
+	if scil > 0 {
+		scil += 3
+	}
+	return scil
+}
+
+// DefaultTraceStatsInterval is the default interval of stats samples
+// emitted by TracedConnection.
+const DefaultTraceStatsInterval = time.Second
+
+// TracedConnection is a connection which reports its events to a tracer and
+// keeps statistics in addition to those of the library.
+// Stream events and statistics are only recorded for data passed through its
+// StreamRecv and StreamSend methods.
+//
+// Errors of its operations include the connection ID.
+type TracedConnection struct {
+	*Connection
+
+	id      []byte
+	tracer  Tracer
+	event   TraceEvent
+	streams map[uint64]*streamState
+	stats   ConnectionStats
+	start   time.Time
+
+	// Lengths of connection IDs in short header packets received and sent.
+	// The peer's length is learned from its long header packets.
+	scidLen int
+	dcidLen int
+
+	statsInterval time.Duration
+	statsTime     time.Time
+	// keepStreams is whether statistics of closed streams are kept.
+	keepStreams bool
+
+	established bool
+	closed      bool
+	closeTraced bool
+}
+
+type streamState struct {
+	StreamStats
+	finSent bool
+	finRecv bool
+	closed  bool
+}
+
+// NewTracedConnection wraps conn created with the source connection ID scid.
+// Durations in statistics are measured from now. Events are not traced if
+// tracer is nil.
+func NewTracedConnection(conn *Connection, scid []byte, tracer Tracer) *TracedConnection {
+	return &TracedConnection{
+		Connection:    conn,
+		id:            append([]byte(nil), scid...),
+		tracer:        tracer,
+		start:         time.Now(),
+		scidLen:       len(scid),
+		dcidLen:       len(scid),
+		statsInterval: DefaultTraceStatsInterval,
+	}
+}
+
+// ID returns the source connection ID.
+func (c *TracedConnection) ID() []byte {
+	return c.id
+}
+
+// SetStatsInterval sets the minimum interval between stats samples, which
+// are taken while the connection is in use and update the minimum RTT.
+// Zero disables sampling.
+func (c *TracedConnection) SetStatsInterval(d time.Duration) {
+	c.statsInterval = d
+}
+
+// KeepStreamStats sets whether statistics of closed streams are kept and
+// reported by ConnectionStats. By default, they are only counted in the
+// connection totals so that long-lived connections do not grow.
+func (c *TracedConnection) KeepStreamStats(v bool) {
+	c.keepStreams = v
+}
+
+// Tracer returns the tracer of the connection.
+func (c *TracedConnection) Tracer() Tracer {
+	return c.tracer
+}
+
+// ConnectionStats collects and returns statistics about the connection.
+// Statistics of open streams, and closed streams if kept, are only included
+// when streams is true.
+func (c *TracedConnection) ConnectionStats(stats *ConnectionStats, streams bool) {
+	*stats = c.stats
+	stats.Streams = nil
+	c.Connection.Stats(&stats.Stats)
+	stats.SmoothedRTT = stats.RTT
+	if stats.RTT > 0 && (stats.MinRTT == 0 || stats.RTT < stats.MinRTT) {
+		stats.MinRTT = stats.RTT
+	}
+	if streams && len(c.streams) > 0 {
+		stats.Streams = make(map[uint64]StreamStats, len(c.streams))
+		for id, st := range c.streams {
+			stats.Streams[id] = st.StreamStats
+		}
+	}
+}
+
+// Recv processes QUIC packets received from the peer.
+func (c *TracedConnection) Recv(b []byte) (int, error) {
+	c.stats.BytesRecv += uint64(len(b))
+	if c.tracer != nil {
+		if n := packetSCIDLen(b); n >= 0 && PacketType(b) != PacketTypeVersionNegotiation {
+			c.dcidLen = n
+		}
+		c.tracePacket(TracePacketReceived, b, c.scidLen)
+	}
+	n, err := c.Connection.Recv(b)
+	err = c.withID(err)
+	c.update()
+	return n, err
+}
+
+// Send writes a single QUIC packet to be sent to the peer.
+func (c *TracedConnection) Send(b []byte) (int, error) {
+	n, err := c.Connection.Send(b)
+	err = c.withID(err)
+	if err == nil {
+		c.stats.BytesSent += uint64(n)
+		if c.tracer != nil {
+			c.tracePacket(TracePacketSent, b[:n], c.dcidLen)
+		}
+	}
+	c.update()
+	return n, err
+}
+
+// OnTimeout processes a timeout event.
+func (c *TracedConnection) OnTimeout() {
+	c.stats.Timeouts++
+	if c.tracer != nil {
+		c.trace(TraceTimeout)
+	}
+	c.Connection.OnTimeout()
+	c.update()
+}
+
+// StreamRecv reads contiguous data from a stream.
+func (c *TracedConnection) StreamRecv(streamID uint64, b []byte) (int, bool, error) {
+	n, fin, err := c.Connection.StreamRecv(streamID, b)
+	err = c.withID(err)
+	if err == nil {
+		if n > 0 && c.stats.TimeToFirstByte == 0 {
+			c.stats.TimeToFirstByte = time.Since(c.start)
+		}
+		c.stats.StreamBytesRecv += uint64(n)
+		st := c.stream(streamID)
+		st.Recv += uint64(n)
+		if fin && !st.finRecv {
+			st.finRecv = true
+			c.closeStream(streamID, st)
+		}
+	}
+	return n, fin, err
+}
+
+// StreamSend writes data to a stream.
+func (c *TracedConnection) StreamSend(streamID uint64, b []byte, fin bool) (int, error) {
+	n, err := c.Connection.StreamSend(streamID, b, fin)
+	err = c.withID(err)
+	if err == nil {
+		c.stats.StreamBytesSent += uint64(n)
+		st := c.stream(streamID)
+		st.Sent += uint64(n)
+		if fin && n == len(b) && !st.finSent {
+			st.finSent = true
+			c.closeStream(streamID, st)
+		}
+	}
+	return n, err
+}
+
+// StreamShutdown shuts down reading or writing from/to the specified stream.
+func (c *TracedConnection) StreamShutdown(streamID uint64, direction Shutdown, errCode uint64) error {
+	return c.withID(c.Connection.StreamShutdown(streamID, direction, errCode))
+}
+
+// Close closes the connection with the given error and reason.
+func (c *TracedConnection) Close(app bool, errCode uint16, reason []byte) error {
+	err := c.Connection.Close(app, errCode, reason)
+	if err != nil {
+		return c.withID(err)
+	}
+	if c.tracer != nil && !c.closeTraced {
+		c.closeTraced = true
+		e := c.newEvent(TraceConnectionClosed)
+		e.Local = true
+		e.App = app
+		e.ErrorCode = errCode
+		e.Reason = reason
+		c.tracer.TraceEvent(e)
+	}
+	return nil
+}
+
+// CloseWithError closes the connection with the transport error and reason.
+func (c *TracedConnection) CloseWithError(code TransportErrorCode, reason string) error {
+	return c.Close(false, uint16(code), []byte(reason))
+}
+
+// CloseApplication closes the connection with the application error and reason.
+func (c *TracedConnection) CloseApplication(code ApplicationErrorCode, reason string) error {
+	return c.Close(true, uint16(code), []byte(reason))
+}
+
+// withID adds the connection ID to the operation error.
+func (c *TracedConnection) withID(err error) error {
+	if e, ok := err.(*OpError); ok && e.ConnID == nil {
+		e.ConnID = c.id
+	}
+	return err
+}
+
+func (c *TracedConnection) stream(id uint64) *streamState {
+	st, ok := c.streams[id]
+	if !ok {
+		if c.streams == nil {
+			c.streams = make(map[uint64]*streamState)
+		}
+		st = &streamState{}
+		c.streams[id] = st
+		if c.tracer != nil {
+			e := c.newEvent(TraceStreamOpened)
+			e.StreamID = id
+			c.tracer.TraceEvent(e)
+		}
+	}
+	return st
+}
+
+// closeStream traces closing of a bidirectional stream when both sides have
+// finished, or a unidirectional stream when its only side has finished.
+// Its statistics are removed unless they are kept.
+func (c *TracedConnection) closeStream(id uint64, st *streamState) {
+	uni := id&0x2 != 0
+	if st.closed || !uni && !(st.finSent && st.finRecv) {
+		return
+	}
+	st.closed = true
+	if !c.keepStreams {
+		delete(c.streams, id)
+	}
+	if c.tracer != nil {
+		e := c.newEvent(TraceStreamClosed)
+		e.StreamID = id
+		c.tracer.TraceEvent(e)
+	}
+}
+
+// update records state changes of the connection and traces stats samples.
+func (c *TracedConnection) update() {
+	if c.closed {
+		return
+	}
+	if !c.established && c.Connection.IsEstablished() {
+		c.established = true
+		c.stats.HandshakeDuration = time.Since(c.start)
+		if c.tracer != nil {
+			c.trace(TraceHandshakeCompleted)
+		}
+	}
+	if c.Connection.IsClosed() {
+		c.closed = true
+		c.sampleStats()
+		if c.tracer != nil {
+			if !c.closeTraced {
+				c.closeTraced = true
+				c.trace(TraceConnectionClosed)
+			}
+		}
+		return
+	}
+	if c.statsInterval > 0 && time.Since(c.statsTime) >= c.statsInterval {
+		c.sampleStats()
+	}
+}
+
+// sampleStats updates the minimum RTT and traces the stats.
+func (c *TracedConnection) sampleStats() {
+	e := c.newEvent(TraceStats)
+	c.Connection.Stats(&e.Stats)
+	c.statsTime = e.Time
+	if e.Stats.RTT > 0 && (c.stats.MinRTT == 0 || e.Stats.RTT < c.stats.MinRTT) {
+		c.stats.MinRTT = e.Stats.RTT
+	}
+	if c.tracer != nil {
+		c.tracer.TraceEvent(e)
+	}
+}
+
+func (c *TracedConnection) tracePacket(typ TraceEventType, b []byte, dcidLen int) {
+	e := c.newEvent(typ)
+	e.PacketType = PacketType(b)
+	e.PacketSize = len(b)
+	e.DCID, _ = PacketDCID(b, dcidLen)
+	c.tracer.TraceEvent(e)
+}
+
+func (c *TracedConnection) trace(typ TraceEventType) {
+	c.tracer.TraceEvent(c.newEvent(typ))
+}
+
+// newEvent resets the reused event.
+func (c *TracedConnection) newEvent(typ TraceEventType) *TraceEvent {
+	c.event = TraceEvent{
+		Time: time.Now(),
+		Type: typ,
+	}
+	return &c.event
+}